@@ -0,0 +1,462 @@
+package planb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/client"
+	"github.com/bsm/redeo/info"
+	"github.com/bsm/redeo/resp"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// serverHealth is the health of a server, as tracked by the leader.
+type serverHealth struct {
+	raft.Server
+
+	// Healthy is true if the server was reached recently
+	// and its log does not lag too far behind.
+	Healthy bool
+	// LastContact is the time the server was last reached.
+	LastContact time.Time
+	// Lag is the number of entries the server lags behind.
+	Lag uint64
+	// StableSince is the time of the last change of Healthy.
+	StableSince time.Time
+	// Priority is the leader priority the server reported.
+	Priority int
+}
+
+// autopilot tracks the health of all servers while the node is the leader.
+// Servers are polled via INFO, their last contact and applied index are
+// recorded. If enabled, dead servers are removed from the cluster. A server is
+// dead once it was not reached for the grace period, or once it failed and
+// another node has taken over its address. Voters are never removed below
+// minQuorum, unless they have been replaced.
+//
+// Tracking restarts on every leadership change, new leaders grant all servers
+// a fresh grace period.
+type autopilot struct {
+	s      *Server
+	logger hclog.Logger
+
+	contactThreshold time.Duration
+	maxLag           uint64
+	cleanup          bool
+	gracePeriod      time.Duration
+	minQuorum        int
+
+	mu      sync.Mutex
+	health  map[raft.ServerID]*serverHealth
+	removed int
+
+	// pools are owned by the loop, they are only used by its probes and
+	// closed by the loop itself. poolMu guards the concurrent lookups of a
+	// single probe.
+	pools  map[raft.ServerAddress]*client.Pool
+	poolMu sync.Mutex
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newAutopilot(s *Server, conf *Config, logger hclog.Logger) *autopilot {
+	p := &autopilot{
+		s:                s,
+		logger:           logger,
+		contactThreshold: conf.Autopilot.LastContactThreshold,
+		maxLag:           conf.Autopilot.MaxLagEntries,
+		cleanup:          conf.Autopilot.CleanupDeadServers,
+		gracePeriod:      conf.Autopilot.DeadServerGracePeriod,
+		minQuorum:        conf.Autopilot.MinQuorum,
+		closing:          make(chan struct{}),
+		closed:           make(chan struct{}),
+	}
+	go p.loop(conf.Autopilot.Interval)
+	return p
+}
+
+// Close stops the autopilot.
+func (p *autopilot) Close() error {
+	close(p.closing)
+	<-p.closed
+	return nil
+}
+
+// Servers returns the tracked health of all servers, sorted by address.
+func (p *autopilot) Servers() []serverHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	servers := make([]serverHealth, 0, len(p.health))
+	for _, h := range p.health {
+		servers = append(servers, *h)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Address < servers[j].Address })
+	return servers
+}
+
+// Register registers the stats with an INFO section.
+func (p *autopilot) Register(section *info.Section) {
+	section.Register("healthy", info.Callback(func() string {
+		return boolString(p.healthy())
+	}))
+	section.Register("failure_tolerance", info.Callback(func() string {
+		return strconv.Itoa(failureTolerance(p.Servers()))
+	}))
+	section.Register("servers", info.Callback(func() string {
+		return strconv.Itoa(len(p.Servers()))
+	}))
+	section.Register("healthy_servers", info.Callback(func() string {
+		var n int
+		for _, h := range p.Servers() {
+			if h.Healthy {
+				n++
+			}
+		}
+		return strconv.Itoa(n)
+	}))
+	section.Register("removed_servers", info.Callback(func() string {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return strconv.Itoa(p.removed)
+	}))
+	section.Register("cleanup_dead_servers", info.StringValue(boolString(p.cleanup)))
+}
+
+// healthy returns true if servers are tracked and all are healthy.
+func (p *autopilot) healthy() bool {
+	servers := p.Servers()
+	for _, h := range servers {
+		if !h.Healthy {
+			return false
+		}
+	}
+	return len(servers) != 0
+}
+
+func (p *autopilot) loop(interval time.Duration) {
+	defer close(p.closed)
+	defer func() { _ = p.closePools() }()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-ticker.C:
+			if p.s.ctrl.State() == raft.Leader {
+				_ = p.check()
+			} else {
+				p.reset()
+			}
+		}
+	}
+}
+
+// reset stops tracking, it must only be called by the loop.
+func (p *autopilot) reset() {
+	p.mu.Lock()
+	p.health = nil
+	p.mu.Unlock()
+
+	_ = p.closePools()
+}
+
+func (p *autopilot) check() error {
+	future := p.s.ctrl.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	servers := future.Configuration().Servers
+	p.prunePools(servers)
+
+	res := p.probe(servers)
+	applied := p.s.ctrl.AppliedIndex()
+	now := time.Now()
+
+	p.mu.Lock()
+	p.update(servers, res.indices, res.priorities, applied, now)
+	dead := p.deadServers(now, res.replaced)
+	p.mu.Unlock()
+
+	for _, srv := range dead {
+		if err := p.s.ctrl.RemoveServer(srv.ID, 0, membershipTimeout).Error(); err != nil {
+			return err
+		}
+		p.logger.Info("planb: autopilot removed dead server", "id", srv.ID, "address", srv.Address)
+
+		p.mu.Lock()
+		delete(p.health, srv.ID)
+		p.removed++
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// probeResult contains the results of a probe.
+type probeResult struct {
+	// indices are the applied indices of all reachable servers.
+	indices map[raft.ServerID]uint64
+	// priorities are the leader priorities of all reachable servers.
+	priorities map[raft.ServerID]int
+	// replaced are the servers whose address is served by another node.
+	replaced map[raft.ServerID]bool
+}
+
+// probe retrieves the state of all servers. It must only be called by
+// the loop, pools are in use until it returns.
+func (p *autopilot) probe(servers []raft.Server) *probeResult {
+	res := &probeResult{
+		indices:    map[raft.ServerID]uint64{p.s.id: p.s.ctrl.AppliedIndex()},
+		priorities: map[raft.ServerID]int{p.s.id: p.s.priority},
+		replaced:   make(map[raft.ServerID]bool),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		if srv.ID == p.s.id {
+			continue
+		}
+
+		wg.Add(1)
+		go func(srv raft.Server) {
+			defer wg.Done()
+
+			info, err := p.retrieveInfo(srv.Address)
+			if err != nil {
+				return
+			}
+
+			// a replacement may have taken over the address
+			id, err := info.NodeID()
+			if err != nil {
+				return
+			} else if id != srv.ID {
+				mu.Lock()
+				res.replaced[srv.ID] = true
+				mu.Unlock()
+				return
+			}
+
+			index, err := info.AppliedIndex()
+			if err != nil {
+				return
+			}
+
+			priority, _ := info.LeaderPriority()
+
+			mu.Lock()
+			res.indices[srv.ID] = index
+			res.priorities[srv.ID] = priority
+			mu.Unlock()
+		}(srv)
+	}
+	wg.Wait()
+	return res
+}
+
+// retrieveInfo retrieves the INFO of the server at addr. Servers
+// which fail to reply within the contact threshold are unhealthy.
+func (p *autopilot) retrieveInfo(addr raft.ServerAddress) (serverInfo, error) {
+	pool, err := p.fetchPool(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := sendPoolCommand(pool, p.contactThreshold, "INFO")
+	if err != nil {
+		return nil, err
+	}
+	return serverInfo(raw), nil
+}
+
+// fetchPool returns the connection pool for addr, pools
+// are kept until the address is removed from the cluster.
+func (p *autopilot) fetchPool(addr raft.ServerAddress) (*client.Pool, error) {
+	p.poolMu.Lock()
+	pool, ok := p.pools[addr]
+	p.poolMu.Unlock()
+	if ok {
+		return pool, nil
+	}
+
+	// dial without holding the lock, unreachable servers must not delay probes
+	pool, err := dialPool(string(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	p.poolMu.Lock()
+	defer p.poolMu.Unlock()
+
+	if other, ok := p.pools[addr]; ok {
+		_ = pool.Close()
+		return other, nil
+	}
+	if p.pools == nil {
+		p.pools = make(map[raft.ServerAddress]*client.Pool)
+	}
+	p.pools[addr] = pool
+	return pool, nil
+}
+
+// prunePools closes the pools of addresses which are no longer in use.
+func (p *autopilot) prunePools(servers []raft.Server) {
+	known := make(map[raft.ServerAddress]bool, len(servers))
+	for _, srv := range servers {
+		known[srv.Address] = true
+	}
+
+	p.poolMu.Lock()
+	defer p.poolMu.Unlock()
+
+	for addr, pool := range p.pools {
+		if !known[addr] {
+			_ = pool.Close()
+			delete(p.pools, addr)
+		}
+	}
+}
+
+// closePools closes all pools.
+func (p *autopilot) closePools() error {
+	p.poolMu.Lock()
+	defer p.poolMu.Unlock()
+
+	var err error
+	for addr, pool := range p.pools {
+		if e := pool.Close(); e != nil {
+			err = e
+		}
+		delete(p.pools, addr)
+	}
+	return err
+}
+
+// update updates the tracked health with the results of a probe.
+func (p *autopilot) update(servers []raft.Server, indices map[raft.ServerID]uint64, priorities map[raft.ServerID]int, applied uint64, now time.Time) {
+	known := p.health
+	p.health = make(map[raft.ServerID]*serverHealth, len(servers))
+
+	for _, srv := range servers {
+		h, ok := known[srv.ID]
+		if !ok {
+			h = &serverHealth{Healthy: true, LastContact: now, StableSince: now}
+		}
+		h.Server = srv
+
+		if index, ok := indices[srv.ID]; ok {
+			h.LastContact = now
+			h.Priority = priorities[srv.ID]
+			h.Lag = 0
+			if applied > index {
+				h.Lag = applied - index
+			}
+		}
+
+		if healthy := now.Sub(h.LastContact) <= p.contactThreshold && h.Lag <= p.maxLag; healthy != h.Healthy {
+			h.Healthy, h.StableSince = healthy, now
+		}
+		p.health[srv.ID] = h
+	}
+}
+
+// deadServers returns the dead servers which can be removed. Failed
+// servers are dead once the grace period has passed or once they have
+// been replaced.
+func (p *autopilot) deadServers(now time.Time, replaced map[raft.ServerID]bool) []raft.Server {
+	if !p.cleanup {
+		return nil
+	}
+
+	var voters int
+	for _, h := range p.health {
+		if h.Suffrage == raft.Voter {
+			voters++
+		}
+	}
+
+	var dead []raft.Server
+	for _, h := range p.health {
+		if h.ID == p.s.id {
+			continue
+		}
+
+		silent := now.Sub(h.LastContact)
+		failed := silent > p.contactThreshold
+		if !failed || (silent < p.gracePeriod && !replaced[h.ID]) {
+			continue
+		}
+
+		// replaced voters are removed regardless of the minimum
+		// quorum, their replacement joins once they are gone
+		if h.Suffrage == raft.Voter {
+			if voters <= p.minQuorum && !replaced[h.ID] {
+				continue
+			}
+			voters--
+		}
+		dead = append(dead, h.Server)
+	}
+	return dead
+}
+
+// failureTolerance returns the number of healthy voters which
+// can fail without the cluster losing its quorum.
+func failureTolerance(servers []serverHealth) int {
+	var voters, healthy int
+	for _, h := range servers {
+		if h.Suffrage != raft.Voter {
+			continue
+		}
+		voters++
+		if h.Healthy {
+			healthy++
+		}
+	}
+
+	if n := healthy - (voters/2 + 1); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// health reports the health of all servers, in INFO format.
+func (s *Server) health(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 0 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	servers := s.pilot.Servers()
+	now := time.Now()
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "healthy:%s\n", boolString(s.pilot.healthy()))
+	fmt.Fprintf(buf, "failure_tolerance:%d\n", failureTolerance(servers))
+	for i, h := range servers {
+		fmt.Fprintf(buf, "server%d:id=%s,address=%s,suffrage=%s,healthy=%s,last_contact_ms=%d,lag=%d,stable_since=%d\n",
+			i, h.ID, h.Address, strings.ToLower(h.Suffrage.String()), boolString(h.Healthy),
+			now.Sub(h.LastContact)/time.Millisecond, h.Lag, h.StableSince.Unix())
+	}
+	w.AppendBulk(buf.Bytes())
+}
+
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
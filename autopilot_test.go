@@ -0,0 +1,119 @@
+package planb
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("autopilot", func() {
+	var subject *autopilot
+	var servers []raft.Server
+	var start time.Time
+
+	BeforeEach(func() {
+		subject = &autopilot{
+			s:                &Server{id: "a"},
+			contactThreshold: time.Second,
+			maxLag:           10,
+			cleanup:          true,
+			gracePeriod:      time.Minute,
+			minQuorum:        3,
+		}
+		servers = []raft.Server{
+			{ID: "a", Address: "10.0.0.1:7230"},
+			{ID: "b", Address: "10.0.0.2:7230"},
+			{ID: "c", Address: "10.0.0.3:7230"},
+			{ID: "d", Address: "10.0.0.4:7230"},
+			{ID: "e", Address: "10.0.0.5:7230", Suffrage: raft.Nonvoter},
+		}
+		start = time.Now()
+		subject.update(servers, nil, nil, 100, start)
+	})
+
+	var ids = func(servers []raft.Server) []raft.ServerID {
+		var ids []raft.ServerID
+		for _, srv := range servers {
+			ids = append(ids, srv.ID)
+		}
+		return ids
+	}
+
+	It("should track health", func() {
+		Expect(subject.healthy()).To(BeTrue())
+		Expect(failureTolerance(subject.Servers())).To(Equal(1))
+
+		now := start.Add(2 * time.Second)
+		subject.update(servers, map[raft.ServerID]uint64{"a": 100, "b": 95, "c": 80, "e": 100}, nil, 100, now)
+
+		health := subject.Servers()
+		Expect(health).To(HaveLen(5))
+		Expect(health[1].Healthy).To(BeTrue())
+		Expect(health[1].Lag).To(Equal(uint64(5)))
+		Expect(health[2].Healthy).To(BeFalse())
+		Expect(health[2].Lag).To(Equal(uint64(20)))
+		Expect(health[2].StableSince).To(Equal(now))
+		Expect(health[3].Healthy).To(BeFalse())
+		Expect(health[3].LastContact).To(Equal(start))
+		Expect(subject.healthy()).To(BeFalse())
+		Expect(failureTolerance(health)).To(Equal(0))
+	})
+
+	It("should remove dead servers after the grace period", func() {
+		now := start.Add(30 * time.Second)
+		subject.update(servers, map[raft.ServerID]uint64{"a": 100, "b": 100}, nil, 100, now)
+		Expect(subject.deadServers(now, nil)).To(BeEmpty())
+
+		now = start.Add(2 * time.Minute)
+		subject.update(servers, map[raft.ServerID]uint64{"a": 100, "b": 100}, nil, 100, now)
+		dead := ids(subject.deadServers(now, nil))
+		Expect(dead).To(HaveLen(2))
+		Expect(dead).To(ContainElement(raft.ServerID("e")))
+		Expect(dead).To(ContainElement(Or(Equal(raft.ServerID("c")), Equal(raft.ServerID("d")))))
+
+		subject.cleanup = false
+		Expect(subject.deadServers(now, nil)).To(BeEmpty())
+	})
+
+	It("should remove failed servers once they are replaced", func() {
+		now := start.Add(30 * time.Second)
+		subject.update(servers, map[raft.ServerID]uint64{"a": 100, "b": 100, "c": 100, "e": 100}, nil, 100, now)
+		Expect(subject.deadServers(now, nil)).To(BeEmpty())
+
+		// joins at other addresses are no replacements
+		servers = append(servers, raft.Server{ID: "f", Address: "10.0.0.6:7230"})
+		now = now.Add(time.Second)
+		subject.update(servers, map[raft.ServerID]uint64{"a": 100, "b": 100, "c": 100, "e": 100, "f": 100}, nil, 100, now)
+		Expect(subject.deadServers(now, nil)).To(BeEmpty())
+
+		replaced := map[raft.ServerID]bool{"c": true, "d": true}
+		Expect(ids(subject.deadServers(now, replaced))).To(ConsistOf(raft.ServerID("d")))
+
+		// replaced voters are removed below the minimum quorum
+		subject.minQuorum = 5
+		Expect(ids(subject.deadServers(now, replaced))).To(ConsistOf(raft.ServerID("d")))
+	})
+
+	It("should track priorities of reachable servers", func() {
+		now := start.Add(2 * time.Second)
+		subject.update(servers, map[raft.ServerID]uint64{"a": 100, "b": 100}, map[raft.ServerID]int{"a": 5, "b": 10, "c": 20}, 100, now)
+
+		health := subject.Servers()
+		Expect(health[0].Priority).To(Equal(5))
+		Expect(health[1].Priority).To(Equal(10))
+		Expect(health[2].Priority).To(Equal(0))
+	})
+
+	It("should reset when losing leadership", func() {
+		subject.reset()
+		Expect(subject.Servers()).To(BeEmpty())
+		Expect(subject.healthy()).To(BeFalse())
+
+		now := start.Add(2 * time.Minute)
+		subject.update(servers, map[raft.ServerID]uint64{"a": 100}, nil, 100, now)
+		Expect(subject.healthy()).To(BeTrue())
+		Expect(subject.deadServers(now, nil)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,342 @@
+package planb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/resp"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	exportFileName    = "dump.planb"
+	exportTempPattern = "export-"
+
+	backupPrefix     = "planb-"
+	backupSuffix     = ".snap"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+var (
+	errExportInProgress = errors.New("planb: export already in progress")
+	errInvalidFileName  = errors.New("planb: invalid file name")
+)
+
+// Export takes a raft snapshot and writes it to a file at path. Exports
+// can be used to seed a fresh cluster, see RestoreFile.
+func (s *Server) Export(path string) error {
+	if !s.exports.Start() {
+		return errExportInProgress
+	}
+
+	err := s.export(path)
+	s.exports.Done(err)
+	return err
+}
+
+// RestoreFile replaces the state of the cluster with an exported snapshot.
+// It can only be called on the leader and is intended for disaster recovery
+// into a fresh cluster, the restored state is replicated to all followers.
+func (s *Server) RestoreFile(path string) error {
+	size, err := verifySnapshotFile(path)
+	if err != nil {
+		return err
+	}
+	return s.restoreFile(path, size)
+}
+
+func (s *Server) export(path string) error {
+	future := s.ctrl.Snapshot()
+	if err := future.Error(); err != nil {
+		return err
+	}
+
+	_, rc, err := future.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(path), exportTempPattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(s.exports.Writer(f), rc); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *Server) restoreFile(path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	meta := &raft.SnapshotMeta{Version: raft.SnapshotVersionMax, Size: size}
+	return s.ctrl.Restore(meta, f, 0)
+}
+
+func (s *Server) snapshot(w resp.ResponseWriter, c *resp.Command) {
+	if err := s.ctrl.Snapshot().Error(); err != nil {
+		w.AppendErrorf("ERR unable to snapshot: %s", err.Error())
+		return
+	}
+	w.AppendOK()
+}
+
+func (s *Server) bgsave(w resp.ResponseWriter, c *resp.Command) {
+	if !s.exports.Start() {
+		w.AppendError("ERR Background save already in progress")
+		return
+	}
+
+	go func() {
+		s.exports.Done(s.export(filepath.Join(s.dir, exportFileName)))
+	}()
+	w.AppendInlineString("Background saving started")
+}
+
+func (s *Server) restore(w resp.ResponseWriter, c *resp.Command) {
+	name := exportFileName
+	switch c.ArgN() {
+	case 0:
+	case 1:
+		name = c.Arg(0).String()
+	default:
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	// only files within the data dir may be restored
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		w.AppendErrorf("ERR unable to restore: %s", errInvalidFileName.Error())
+		return
+	}
+
+	if err := s.RestoreFile(filepath.Join(s.dir, name)); err != nil {
+		w.AppendErrorf("ERR unable to restore: %s", err.Error())
+		return
+	}
+	w.AppendOK()
+}
+
+// verifySnapshotFile verifies the snapshot at path and returns its size.
+func verifySnapshotFile(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return verifySnapshot(f)
+}
+
+// --------------------------------------------------------------------
+
+// DirBackupTarget is a BackupTarget which stores
+// backups as files in a local directory.
+type DirBackupTarget string
+
+// Put implements BackupTarget.
+func (d DirBackupTarget) Put(name string, r io.Reader) error {
+	if name != filepath.Base(name) {
+		return errInvalidFileName
+	}
+	if err := os.MkdirAll(string(d), 0777); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(string(d), exportTempPattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(string(d), name))
+}
+
+// List implements BackupTarget.
+func (d DirBackupTarget) List() ([]string, error) {
+	files, err := ioutil.ReadDir(string(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), exportTempPattern) {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete implements BackupTarget.
+func (d DirBackupTarget) Delete(name string) error {
+	if name != filepath.Base(name) {
+		return errInvalidFileName
+	}
+	return os.Remove(filepath.Join(string(d), name))
+}
+
+// --------------------------------------------------------------------
+
+// backupScheduler periodically ships the latest snapshot
+// to a backup target, while the node is the leader.
+type backupScheduler struct {
+	ctrl     *raft.Raft
+	snaps    raft.SnapshotStore
+	target   BackupTarget
+	retain   int
+	progress *snapshotProgress
+	lastID   string
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newBackupScheduler(ctrl *raft.Raft, snaps raft.SnapshotStore, target BackupTarget, interval time.Duration, retain int, progress *snapshotProgress) *backupScheduler {
+	s := &backupScheduler{
+		ctrl:     ctrl,
+		snaps:    snaps,
+		target:   target,
+		retain:   retain,
+		progress: progress,
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go s.loop(interval)
+	return s
+}
+
+// Close stops the scheduler.
+func (s *backupScheduler) Close() error {
+	close(s.closing)
+	<-s.closed
+	return nil
+}
+
+func (s *backupScheduler) loop(interval time.Duration) {
+	defer close(s.closed)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			if s.ctrl.State() == raft.Leader {
+				_ = s.backup()
+			}
+		}
+	}
+}
+
+func (s *backupScheduler) backup() error {
+	meta, err := s.latest()
+	if err != nil || meta == nil || meta.ID == s.lastID {
+		return err
+	}
+
+	s.progress.Start()
+	err = s.ship(meta)
+	s.progress.Done(err)
+	if err != nil {
+		return err
+	}
+
+	s.lastID = meta.ID
+	return s.prune()
+}
+
+// latest returns the latest snapshot, a new snapshot is taken
+// if entries were applied since. It returns nil if there is
+// nothing to snapshot.
+func (s *backupScheduler) latest() (*raft.SnapshotMeta, error) {
+	metas, err := s.snaps.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(metas) != 0 && metas[0].Index >= s.ctrl.AppliedIndex() {
+		return metas[0], nil
+	}
+
+	if err := s.ctrl.Snapshot().Error(); err == raft.ErrNothingNewToSnapshot {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if metas, err = s.snaps.List(); err != nil || len(metas) == 0 {
+		return nil, err
+	}
+	return metas[0], nil
+}
+
+func (s *backupScheduler) ship(meta *raft.SnapshotMeta) error {
+	_, rc, err := s.snaps.Open(meta.ID)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	name := fmt.Sprintf("%s%s-%020d%s", backupPrefix, time.Now().UTC().Format(backupTimeFormat), meta.Index, backupSuffix)
+	return s.target.Put(name, s.progress.Reader(rc))
+}
+
+// prune removes backups beyond the retention limit, oldest first.
+func (s *backupScheduler) prune() error {
+	names, err := s.target.List()
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, name := range names {
+		if strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > s.retain {
+		if err := s.target.Delete(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package planb_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bsm/planb"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DirBackupTarget", func() {
+	var dir string
+	var subject planb.DirBackupTarget
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "planb-backup-test")
+		Expect(err).NotTo(HaveOccurred())
+		subject = planb.DirBackupTarget(filepath.Join(dir, "backups"))
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should put/list/delete", func() {
+		Expect(subject.List()).To(BeEmpty())
+		Expect(subject.Put("b1.snap", bytes.NewReader([]byte("data1")))).To(Succeed())
+		Expect(subject.Put("b2.snap", bytes.NewReader([]byte("data2")))).To(Succeed())
+		Expect(subject.List()).To(Equal([]string{"b1.snap", "b2.snap"}))
+		Expect(ioutil.ReadFile(filepath.Join(dir, "backups", "b2.snap"))).To(Equal([]byte("data2")))
+
+		Expect(subject.Delete("b1.snap")).To(Succeed())
+		Expect(subject.List()).To(Equal([]string{"b2.snap"}))
+	})
+
+	It("should reject invalid names", func() {
+		Expect(subject.Put("../b1.snap", bytes.NewReader(nil))).To(HaveOccurred())
+		Expect(subject.Delete("../b1.snap")).To(HaveOccurred())
+	})
+
+})
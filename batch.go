@@ -0,0 +1,194 @@
+package planb
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type batchResult struct {
+	res interface{}
+	err error
+}
+
+type batchRequest struct {
+	data    []byte
+	timeout time.Duration
+	done    chan batchResult
+}
+
+// logBatcher coalesces concurrently proposed commands
+// into batched log entries.
+type logBatcher struct {
+	ctrl    *raft.Raft
+	maxSize int
+	window  time.Duration
+
+	reqs    chan *batchRequest
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newLogBatcher(ctrl *raft.Raft, maxSize int, window time.Duration) *logBatcher {
+	b := &logBatcher{
+		ctrl:    ctrl,
+		maxSize: maxSize,
+		window:  window,
+		reqs:    make(chan *batchRequest, maxSize),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go b.loop()
+	return b
+}
+
+// Apply submits a codec-encoded command and waits for the result.
+// Like raft.Apply, the timeout only limits the time to enqueue the
+// command. Once enqueued, the command may be applied and Apply
+// waits for the outcome.
+func (b *logBatcher) Apply(data []byte, timeout time.Duration) (interface{}, error) {
+	res := b.ApplyAll([][]byte{data}, timeout)
+	return res[0].res, res[0].err
+}
+
+// ApplyAll submits a sequence of codec-encoded commands, which are
+// applied in order, and waits for their results. Commands which
+// follow a command that could not be enqueued are rejected.
+func (b *logBatcher) ApplyAll(data [][]byte, timeout time.Duration) []batchResult {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	res := make([]batchResult, len(data))
+	reqs := make([]*batchRequest, 0, len(data))
+
+ENQUEUE:
+	for i := range data {
+		req := &batchRequest{data: data[i], timeout: timeout, done: make(chan batchResult, 1)}
+		select {
+		case b.reqs <- req:
+			reqs = append(reqs, req)
+		case <-b.closing:
+			for j := i; j < len(data); j++ {
+				res[j].err = raft.ErrRaftShutdown
+			}
+			break ENQUEUE
+		case <-timer.C:
+			for j := i; j < len(data); j++ {
+				res[j].err = raft.ErrEnqueueTimeout
+			}
+			break ENQUEUE
+		}
+	}
+
+	for i, req := range reqs {
+		res[i] = b.wait(req)
+	}
+	return res
+}
+
+// wait waits for the result of an enqueued request.
+func (b *logBatcher) wait(req *batchRequest) batchResult {
+	select {
+	case res := <-req.done:
+		return res
+	case <-b.closed:
+	}
+
+	select {
+	case res := <-req.done:
+		return res
+	default:
+		return batchResult{err: raft.ErrRaftShutdown}
+	}
+}
+
+// Close stops the batcher.
+func (b *logBatcher) Close() error {
+	close(b.closing)
+	<-b.closed
+	return nil
+}
+
+func (b *logBatcher) loop() {
+	defer close(b.closed)
+
+	for {
+		var batch []*batchRequest
+		select {
+		case req := <-b.reqs:
+			batch = append(batch, req)
+		case <-b.closing:
+			b.drain()
+			return
+		}
+
+		timer := time.NewTimer(b.window)
+	COLLECT:
+		for len(batch) < b.maxSize {
+			select {
+			case req := <-b.reqs:
+				batch = append(batch, req)
+			case <-timer.C:
+				break COLLECT
+			case <-b.closing:
+				break COLLECT
+			}
+		}
+		timer.Stop()
+
+		b.apply(batch)
+	}
+}
+
+// drain rejects all pending requests.
+func (b *logBatcher) drain() {
+	for {
+		select {
+		case req := <-b.reqs:
+			req.done <- batchResult{err: raft.ErrRaftShutdown}
+		default:
+			return
+		}
+	}
+}
+
+func (b *logBatcher) apply(batch []*batchRequest) {
+	var timeout time.Duration
+	cmds := make([][]byte, len(batch))
+	for i, req := range batch {
+		cmds[i] = req.data
+		if req.timeout > timeout {
+			timeout = req.timeout
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := encodeLogStamp(buf); err != nil {
+		for _, req := range batch {
+			req.done <- batchResult{err: err}
+		}
+		return
+	}
+	encodeCommandsEntry(buf, logEntryBatch, cmds)
+	future := b.ctrl.Apply(buf.Bytes(), timeout)
+
+	go func() {
+		if err := future.Error(); err != nil {
+			for _, req := range batch {
+				req.done <- batchResult{err: err}
+			}
+			return
+		}
+
+		res := future.Response()
+		rs, ok := res.([]interface{})
+		for i, req := range batch {
+			if ok && i < len(rs) {
+				req.done <- batchResult{res: rs[i]}
+			} else {
+				req.done <- batchResult{res: res}
+			}
+		}
+	}()
+}
@@ -0,0 +1,361 @@
+// Package boltstore implements a durable planb.Store, backed by BoltDB.
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/boltdb/bolt"
+	"github.com/bsm/planb"
+)
+
+var errInvalidKey = errors.New("boltstore: invalid key")
+
+var (
+	bucketData = []byte("data")
+	bucketMeta = []byte("meta")
+
+	metaAppliedIndex = []byte("applied_index")
+)
+
+var (
+	_ planb.IndexedStore = (*Store)(nil)
+	_ planb.Snapshotter  = (*Store)(nil)
+)
+
+// Store is a durable, disk-backed store. It keeps track of the
+// last applied raft index, allowing servers to skip entries
+// which have already been applied before a restart.
+//
+// Snapshots are raw copies of the underlying database file and
+// are not compatible with planb.InmemStore snapshots.
+type Store struct {
+	path string
+	opts *bolt.Options
+
+	db      *bolt.DB
+	mu      sync.RWMutex // protects db on restore
+	applied uint64       // atomic
+}
+
+// txKey is the context key of the write transaction of a log entry.
+type txKey struct{ s *Store }
+
+// Open opens a store at path, creating the database
+// file if it does not exist. Options are optional.
+func Open(path string, opts *bolt.Options) (*Store, error) {
+	s := &Store{path: path, opts: opts}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Path returns the path of the database file.
+func (s *Store) Path() string { return s.path }
+
+// Get retrieves a key. Returns nil if the key does not exist.
+func (s *Store) Get(key []byte) ([]byte, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but reads within the write transaction
+// of the log entry which is applied with ctx, if any.
+func (s *Store) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errInvalidKey
+	}
+
+	var val []byte
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketData).Get(key); v != nil {
+			val = append(make([]byte, 0, len(v)), v...)
+		}
+		return nil
+	})
+	return val, err
+}
+
+// Put sets a key. Passing a nil value deletes the key.
+func (s *Store) Put(key, val []byte) error {
+	return s.PutContext(context.Background(), key, val)
+}
+
+// PutContext is like Put, but writes within the write transaction of
+// the log entry which is applied with ctx, if any. Handlers of mutating
+// commands must pass the command context, changes are then persisted
+// atomically with the applied index.
+func (s *Store) PutContext(ctx context.Context, key, val []byte) error {
+	if len(key) == 0 {
+		return errInvalidKey
+	}
+	if val == nil {
+		return s.DeleteContext(ctx, key)
+	}
+
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketData).Put(key, val)
+	})
+}
+
+// Delete deletes a key.
+func (s *Store) Delete(key []byte) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but writes within the write
+// transaction of the log entry which is applied with ctx, if any.
+func (s *Store) DeleteContext(ctx context.Context, key []byte) error {
+	if len(key) == 0 {
+		return errInvalidKey
+	}
+
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketData).Delete(key)
+	})
+}
+
+// Iterate calls fn for each key starting with prefix, in
+// lexicographical order. Key and value are only valid for
+// the duration of the call. Iteration stops at the first
+// error returned by fn.
+func (s *Store) Iterate(prefix []byte, fn func(key, val []byte) error) error {
+	return s.IterateContext(context.Background(), prefix, fn)
+}
+
+// IterateContext is like Iterate, but reads within the write
+// transaction of the log entry which is applied with ctx, if any.
+// Within that transaction, fn must not modify the store.
+func (s *Store) IterateContext(ctx context.Context, prefix []byte, fn func(key, val []byte) error) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		cur := tx.Bucket(bucketData).Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AppliedIndex implements planb.IndexedStore.
+func (s *Store) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&s.applied)
+}
+
+// ApplyIndexed implements planb.IndexedStore. The context passed to apply
+// carries a write transaction, which is committed together with the
+// applied index. Reads and writes which are issued with that context,
+// through the Context methods, share the transaction. All other calls
+// use their own transactions and must not be issued from within apply,
+// since bolt only allows a single writer at a time.
+func (s *Store) ApplyIndexed(index uint64, apply func(context.Context)) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	apply(context.WithValue(context.Background(), txKey{s: s}, tx))
+
+	if err := putAppliedIndex(tx, index); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&s.applied, index)
+	return nil
+}
+
+// Snapshot implements planb.Store.
+func (s *Store) Snapshot(w io.Writer) error {
+	snap, err := s.Freeze()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return snap.Persist(w)
+}
+
+// Freeze implements planb.Snapshotter. The returned snapshot holds a read
+// transaction open until it is released. Writes which need to grow the
+// database file block until all open snapshots are released, see
+// bolt.Options.InitialMmapSize.
+func (s *Store) Freeze() (planb.StoreSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{tx: tx}, nil
+}
+
+// Restore implements planb.Store. The data is streamed to a temporary file
+// which atomically replaces the database file once it has been validated.
+func (s *Store) Restore(r io.Reader) error {
+	return s.restore(r, nil)
+}
+
+// RestoreIndexed implements planb.IndexedStore. Like Restore, but the
+// applied index is reset before the database file is replaced.
+func (s *Store) RestoreIndexed(r io.Reader, index uint64) error {
+	return s.restore(r, func(tx *bolt.Tx) error {
+		return putAppliedIndex(tx, index)
+	})
+}
+
+func (s *Store) restore(r io.Reader, prepare func(*bolt.Tx) error) error {
+	tmp := s.path + ".restore"
+	if err := writeFile(tmp, r); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// validate the restored file before replacing the current database
+	db, err := bolt.Open(tmp, 0600, s.opts)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if prepare != nil {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists(bucketMeta); err != nil {
+				return err
+			}
+			return prepare(tx)
+		}); err != nil {
+			_ = db.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	if err := db.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Close()
+}
+
+func (s *Store) open() error {
+	db, err := bolt.Open(s.path, 0600, s.opts)
+	if err != nil {
+		return err
+	}
+
+	var applied uint64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketData); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(metaAppliedIndex); len(v) == 8 {
+			applied = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	}); err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	s.db = db
+	atomic.StoreUint64(&s.applied, applied)
+	return nil
+}
+
+// view runs fn within the write transaction of the log entry
+// applied with ctx, if any, or within a read-only transaction.
+func (s *Store) view(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if tx, ok := ctx.Value(txKey{s: s}).(*bolt.Tx); ok {
+		return fn(tx)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.View(fn)
+}
+
+// update runs fn within the write transaction of the log entry
+// applied with ctx, if any, or within a new write transaction.
+func (s *Store) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if tx, ok := ctx.Value(txKey{s: s}).(*bolt.Tx); ok {
+		return fn(tx)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(fn)
+}
+
+func putAppliedIndex(tx *bolt.Tx, index uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+	return tx.Bucket(bucketMeta).Put(metaAppliedIndex, buf)
+}
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// --------------------------------------------------------------------
+
+type snapshot struct{ tx *bolt.Tx }
+
+// Persist implements planb.StoreSnapshot.
+func (s *snapshot) Persist(w io.Writer) error {
+	_, err := s.tx.WriteTo(w)
+	return err
+}
+
+// Release implements planb.StoreSnapshot.
+func (s *snapshot) Release() {
+	_ = s.tx.Rollback()
+}
@@ -0,0 +1,162 @@
+package boltstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bsm/planb/boltstore"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+	var subject *boltstore.Store
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "planb-boltstore-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		subject, err = boltstore.Open(filepath.Join(dir, "store.db"), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(subject.Put([]byte("key1"), []byte("val1"))).To(Succeed())
+		Expect(subject.Put([]byte("key2"), []byte("val2"))).To(Succeed())
+		Expect(subject.Put([]byte("other"), []byte("val3"))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(subject.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should GET", func() {
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val1")))
+		Expect(subject.Get([]byte("key3"))).To(BeNil())
+		_, err := subject.Get(nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should PUT/DELETE", func() {
+		Expect(subject.Put([]byte("key1"), []byte("val4"))).To(Succeed())
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val4")))
+
+		Expect(subject.Delete([]byte("key1"))).To(Succeed())
+		Expect(subject.Get([]byte("key1"))).To(BeNil())
+
+		Expect(subject.Put([]byte("key2"), nil)).To(Succeed())
+		Expect(subject.Get([]byte("key2"))).To(BeNil())
+	})
+
+	It("should iterate", func() {
+		var keys []string
+		Expect(subject.Iterate([]byte("key"), func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})).To(Succeed())
+		Expect(keys).To(Equal([]string{"key1", "key2"}))
+
+		keys = keys[:0]
+		Expect(subject.Iterate(nil, func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})).To(Succeed())
+		Expect(keys).To(Equal([]string{"key1", "key2", "other"}))
+	})
+
+	var applyNop = func(context.Context) {}
+
+	It("should track applied index", func() {
+		Expect(subject.AppliedIndex()).To(Equal(uint64(0)))
+		Expect(subject.ApplyIndexed(7, applyNop)).To(Succeed())
+		Expect(subject.AppliedIndex()).To(Equal(uint64(7)))
+
+		Expect(subject.Close()).To(Succeed())
+
+		var err error
+		subject, err = boltstore.Open(filepath.Join(dir, "store.db"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subject.AppliedIndex()).To(Equal(uint64(7)))
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val1")))
+	})
+
+	It("should apply writes with the applied index", func() {
+		Expect(subject.ApplyIndexed(3, func(ctx context.Context) {
+			defer GinkgoRecover()
+
+			Expect(subject.PutContext(ctx, []byte("key1"), []byte("val4"))).To(Succeed())
+			Expect(subject.GetContext(ctx, []byte("key1"))).To(Equal([]byte("val4")))
+			Expect(subject.DeleteContext(ctx, []byte("key2"))).To(Succeed())
+			Expect(subject.GetContext(ctx, []byte("key2"))).To(BeNil())
+
+			// other readers use their own transactions
+			Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val1")))
+			Expect(subject.Get([]byte("key2"))).To(Equal([]byte("val2")))
+		})).To(Succeed())
+		Expect(subject.AppliedIndex()).To(Equal(uint64(3)))
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val4")))
+		Expect(subject.Get([]byte("key2"))).To(BeNil())
+
+		// writes and index are only persisted together
+		Expect(subject.Close()).To(Succeed())
+		var err error
+		subject, err = boltstore.Open(filepath.Join(dir, "store.db"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subject.AppliedIndex()).To(Equal(uint64(3)))
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val4")))
+	})
+
+	It("should snapshot/restore", func() {
+		Expect(subject.ApplyIndexed(5, applyNop)).To(Succeed())
+
+		snap, err := subject.Freeze()
+		Expect(err).NotTo(HaveOccurred())
+
+		buf := new(bytes.Buffer)
+		done := make(chan error, 1)
+		go func() {
+			defer snap.Release()
+			done <- snap.Persist(buf)
+		}()
+
+		Expect(subject.Put([]byte("key1"), []byte("val4"))).To(Succeed())
+		Expect(subject.ApplyIndexed(6, applyNop)).To(Succeed())
+		Expect(<-done).To(Succeed())
+
+		Expect(subject.Put([]byte("key4"), []byte("val5"))).To(Succeed())
+		Expect(subject.Restore(buf)).To(Succeed())
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val1")))
+		Expect(subject.Get([]byte("key4"))).To(BeNil())
+		Expect(subject.AppliedIndex()).To(Equal(uint64(5)))
+	})
+
+	It("should reset the applied index on restore", func() {
+		Expect(subject.ApplyIndexed(5, applyNop)).To(Succeed())
+
+		buf := new(bytes.Buffer)
+		Expect(subject.Snapshot(buf)).To(Succeed())
+		Expect(subject.ApplyIndexed(9, applyNop)).To(Succeed())
+
+		Expect(subject.RestoreIndexed(buf, 2)).To(Succeed())
+		Expect(subject.AppliedIndex()).To(Equal(uint64(2)))
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val1")))
+	})
+
+	It("should reject invalid snapshots", func() {
+		Expect(subject.Restore(bytes.NewBufferString("not a database"))).NotTo(Succeed())
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val1")))
+	})
+
+})
+
+// --------------------------------------------------------------------
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "planb/boltstore")
+}
@@ -0,0 +1,333 @@
+package planb
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/resp"
+	"github.com/bsm/redeoraft"
+	"github.com/hashicorp/raft"
+)
+
+// clusterFormer discovers seed peers on start. Once the expected number of
+// voters is found, the seed with the lowest address bootstraps a new cluster,
+// all other nodes wait until they can join it. If a seed is already member
+// of a cluster, it asks that cluster to add the local node.
+type clusterFormer struct {
+	ctrl   *raft.Raft
+	local  raft.Server
+	seeds  []string
+	expect int
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newClusterFormer(ctrl *raft.Raft, local raft.Server, seeds []string, expect int, interval time.Duration) *clusterFormer {
+	f := &clusterFormer{
+		ctrl:    ctrl,
+		local:   local,
+		seeds:   seeds,
+		expect:  expect,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go f.loop(interval)
+	return f
+}
+
+// Close stops the discovery.
+func (f *clusterFormer) Close() error {
+	close(f.closing)
+	<-f.closed
+	return nil
+}
+
+func (f *clusterFormer) loop(interval time.Duration) {
+	defer close(f.closed)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if done, _ := f.attempt(); done {
+			return
+		}
+
+		select {
+		case <-f.closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// attempt performs a single discovery attempt, it returns true once the
+// local node is a member of a cluster. Replacements may receive the
+// configuration of a cluster before they are added to it.
+func (f *clusterFormer) attempt() (bool, error) {
+	if member, err := isMember(f.ctrl, f.local.ID); err != nil {
+		return false, err
+	} else if member {
+		return true, nil
+	}
+
+	servers := []raft.Server{f.local}
+	voters := 0
+	if f.local.Suffrage == raft.Voter {
+		voters++
+	}
+
+	for _, addr := range f.seeds {
+		if addr == string(f.local.Address) {
+			continue
+		}
+
+		info, err := retrieveServerInfo(addr)
+		if err != nil {
+			continue
+		}
+		peer, err := info.Server()
+		if err != nil || peer.ID == f.local.ID {
+			continue
+		}
+
+		// join existing clusters
+		if size, err := info.ClusterSize(); err != nil {
+			continue
+		} else if size != 0 {
+			return false, joinCluster(addr, f.local)
+		}
+		servers = append(servers, *peer)
+		if peer.Suffrage == raft.Voter {
+			voters++
+		}
+	}
+
+	// non-voters never bootstrap a cluster themselves, neither do seeds
+	// other than the lowest, as partial views could form split brains
+	if f.local.Suffrage != raft.Voter || voters < f.expect || !f.isBootstrapper() {
+		return false, nil
+	}
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Address < servers[j].Address })
+	if err := f.ctrl.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+		return false, err
+	}
+	return true, nil
+}
+
+// isBootstrapper returns true if the local node has the lowest seed address.
+func (f *clusterFormer) isBootstrapper() bool {
+	if len(f.seeds) == 0 {
+		return false
+	}
+
+	lowest := f.seeds[0]
+	for _, addr := range f.seeds[1:] {
+		if addr < lowest {
+			lowest = addr
+		}
+	}
+	return lowest == string(f.local.Address)
+}
+
+// --------------------------------------------------------------------
+
+// membershipTimeout limits the duration of membership changes.
+const membershipTimeout = 10 * time.Second
+
+// joinCluster asks the cluster member at addr to add local,
+// the request is forwarded to the leader.
+func joinCluster(addr string, local raft.Server) error {
+	subcmd := "ADD"
+	if local.Suffrage == raft.Nonvoter {
+		subcmd = "ADD-NONVOTER"
+	}
+
+	_, err := sendCommand(addr, "RAFT", subcmd, string(local.ID), string(local.Address))
+	return err
+}
+
+func (s *Server) join(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	if err := joinCluster(c.Arg(0).String(), s.local()); err != nil {
+		w.AppendErrorf("ERR unable to join cluster: %s", err.Error())
+		return
+	}
+	w.AppendOK()
+}
+
+// leave removes the local node from the cluster. A leader
+// transfers leadership first and is then removed by the new leader.
+func (s *Server) leave(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 0 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	future := s.ctrl.GetConfiguration()
+	if err := future.Error(); err != nil {
+		w.AppendErrorf("ERR unable to leave cluster: %s", err.Error())
+		return
+	}
+
+	var member bool
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == s.id {
+			member = true
+		}
+	}
+	if !member {
+		w.AppendError("ERR unable to leave cluster: node is not a member")
+		return
+	} else if countVoters(future.Configuration(), s.id) == 0 {
+		w.AppendErrorf("ERR unable to leave cluster: %s", errLastVoter.Error())
+		return
+	}
+
+	if s.ctrl.State() == raft.Leader {
+		if _, err := s.transferLeadership(nil); err != nil {
+			w.AppendErrorf("ERR unable to leave cluster: %s", err.Error())
+			return
+		}
+	}
+
+	s.forwardRaftCmd(w, resp.NewCommand("RAFT REMOVE", resp.CommandArgument(s.id)), redeoraft.RemovePeer(s.ctrl))
+}
+
+func (s *Server) addNonvoter(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 2 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	if err := s.ctrl.AddNonvoter(raft.ServerID(c.Arg(0)), raft.ServerAddress(c.Arg(1)), 0, membershipTimeout).Error(); err != nil {
+		w.AppendError("ERR " + err.Error())
+		return
+	}
+	w.AppendOK()
+}
+
+// promote turns a non-voter into a voter.
+func (s *Server) promote(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	future := s.ctrl.GetConfiguration()
+	if err := future.Error(); err != nil {
+		w.AppendError("ERR " + err.Error())
+		return
+	}
+
+	id := raft.ServerID(c.Arg(0))
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID != id {
+			continue
+		}
+
+		if err := s.ctrl.AddVoter(srv.ID, srv.Address, future.Index(), membershipTimeout).Error(); err != nil {
+			w.AppendError("ERR " + err.Error())
+			return
+		}
+		w.AppendOK()
+		return
+	}
+	w.AppendErrorf("ERR unknown server %s", id)
+}
+
+// demote turns a voter into a non-voter.
+func (s *Server) demote(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	if err := s.ctrl.DemoteVoter(raft.ServerID(c.Arg(0)), 0, membershipTimeout).Error(); err != nil {
+		w.AppendError("ERR " + err.Error())
+		return
+	}
+	w.AppendOK()
+}
+
+// forwardRaftCmd serves raft subcommands which must be handled by the
+// leader, followers forward these to the current leader.
+func (s *Server) forwardRaftCmd(w resp.ResponseWriter, c *resp.Command, h redeo.Handler) {
+	if s.ctrl.State() == raft.Leader {
+		h.ServeRedeo(w, c)
+		return
+	}
+
+	// restore the original command, i.e. RAFT <SUBCOMMAND> args...
+	name := strings.SplitN(c.Name, " ", 2)
+	args := make([]resp.CommandArgument, 0, len(c.Args)+1)
+	if len(name) == 2 {
+		args = append(args, resp.CommandArgument(name[1]))
+	}
+	args = append(args, c.Args...)
+	cmd := resp.NewCommand(name[0], args...)
+	cmd.SetContext(c.Context())
+	forwardToLeader(s, w, cmd, nil, "ERR")
+}
+
+// leaderRaftCmd wraps h, see forwardRaftCmd.
+func (s *Server) leaderRaftCmd(h redeo.Handler) redeo.Handler {
+	return redeo.HandlerFunc(func(w resp.ResponseWriter, c *resp.Command) {
+		s.forwardRaftCmd(w, c, h)
+	})
+}
+
+// suffrage returns the suffrage of the local node in the latest configuration,
+// or the configured suffrage before the node joins a cluster.
+func (s *Server) suffrage() raft.ServerSuffrage {
+	if future := s.ctrl.GetConfiguration(); future.Error() == nil {
+		for _, srv := range future.Configuration().Servers {
+			if srv.ID == s.id {
+				return srv.Suffrage
+			}
+		}
+	}
+	return s.local().Suffrage
+}
+
+// local returns the configured identity of the local node.
+func (s *Server) local() raft.Server {
+	local := raft.Server{ID: s.id, Address: s.addr}
+	if s.nonvoter {
+		local.Suffrage = raft.Nonvoter
+	}
+	return local
+}
+
+// isMember returns true if id is part of the latest configuration.
+func isMember(ctrl *raft.Raft, id raft.ServerID) (bool, error) {
+	future := ctrl.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return false, err
+	}
+
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// clusterSize returns the number of servers in the latest
+// configuration, which is zero before the node joins a cluster.
+func clusterSize(ctrl *raft.Raft) (int, error) {
+	future := ctrl.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return 0, err
+	}
+	return len(future.Configuration().Servers), nil
+}
@@ -0,0 +1,202 @@
+package planb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/bsm/redeo/resp"
+)
+
+var errInvalidLogEntry = errors.New("planb: invalid log entry")
+
+// Codec encodes and decodes commands for the replicated log.
+type Codec interface {
+	// Encode writes an encoded command to w.
+	Encode(w io.Writer, cmd *resp.Command) error
+	// Decode decodes data into cmd.
+	Decode(data []byte, cmd *resp.Command) error
+}
+
+// log entry headers, legacy gob-encoded entries have no header.
+// Header values are in the 0x80-0xf7 range which can never be
+// the first byte of a gob stream.
+const (
+	logEntryCommand byte = 0x81
+	logEntryBatch   byte = 0x82
+	logEntryMulti   byte = 0x83
+	logEntryStamped byte = 0x84
+	logEntryExpire  byte = 0x85
+)
+
+// logStamp is captured by the leader when a command is proposed
+type logStamp struct {
+	Time time.Time
+	Seed int64
+}
+
+// encodeLogStamp writes a stamp header which must be followed by
+// the actual log entry. Seeds are read from crypto/rand, they must
+// not be predictable from the seeds of previous entries.
+func encodeLogStamp(buf *bytes.Buffer) error {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	if _, err := rand.Read(tmp[:8]); err != nil {
+		return err
+	}
+	seed := int64(binary.BigEndian.Uint64(tmp[:8]) >> 1)
+
+	buf.WriteByte(logEntryStamped)
+	n := binary.PutVarint(tmp, time.Now().UnixNano())
+	buf.Write(tmp[:n])
+	n = binary.PutVarint(tmp, seed)
+	buf.Write(tmp[:n])
+	return nil
+}
+
+// decodeLogStamp decodes a stamp, excluding the header byte and
+// returns the remaining data.
+func decodeLogStamp(data []byte) (*logStamp, []byte, error) {
+	nanos, n := binary.Varint(data)
+	if n <= 0 {
+		return nil, nil, errInvalidLogEntry
+	}
+	data = data[n:]
+
+	seed, n := binary.Varint(data)
+	if n <= 0 {
+		return nil, nil, errInvalidLogEntry
+	}
+	return &logStamp{Time: time.Unix(0, nanos), Seed: seed}, data[n:], nil
+}
+
+func encodeLogEntry(buf *bytes.Buffer, codec Codec, cmd *resp.Command) error {
+	buf.WriteByte(logEntryCommand)
+	return codec.Encode(buf, cmd)
+}
+
+func decodeLogEntry(data []byte, codec Codec, cmd *resp.Command) error {
+	if len(data) == 0 {
+		return errInvalidLogEntry
+	}
+
+	switch data[0] {
+	case logEntryCommand:
+		return codec.Decode(data[1:], cmd)
+	case logEntryBatch, logEntryMulti, logEntryExpire:
+		return errInvalidLogEntry
+	}
+	if data[0] >= 0x80 && data[0] < 0xf8 {
+		return errInvalidLogEntry
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(cmd)
+}
+
+// encodeCommandsEntry encodes multiple codec-encoded commands into a single
+// entry. Header must be either logEntryBatch or logEntryMulti. It is also
+// used to encode the keys of logEntryExpire entries.
+func encodeCommandsEntry(buf *bytes.Buffer, header byte, cmds [][]byte) {
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	buf.WriteByte(header)
+	n := binary.PutUvarint(tmp, uint64(len(cmds)))
+	buf.Write(tmp[:n])
+
+	for _, cmd := range cmds {
+		n = binary.PutUvarint(tmp, uint64(len(cmd)))
+		buf.Write(tmp[:n])
+		buf.Write(cmd)
+	}
+}
+
+// decodeCommandsEntry decodes a multi-command entry, excluding the
+// header byte, into a slice of codec-encoded commands.
+func decodeCommandsEntry(data []byte) ([][]byte, error) {
+	u, n := binary.Uvarint(data)
+	if n <= 0 || u > uint64(len(data)) {
+		return nil, errInvalidLogEntry
+	}
+	data = data[n:]
+
+	var err error
+	cmds := make([][]byte, int(u))
+	for i := range cmds {
+		if cmds[i], data, err = readBinaryField(data); err != nil {
+			return nil, err
+		}
+	}
+	return cmds, nil
+}
+
+// --------------------------------------------------------------------
+
+// BinaryCodec is a compact, length-prefixed binary command codec.
+// It is the default codec.
+type BinaryCodec struct{}
+
+// Encode implements Codec.
+func (BinaryCodec) Encode(w io.Writer, cmd *resp.Command) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	n := binary.PutUvarint(buf, uint64(len(cmd.Name)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, cmd.Name); err != nil {
+		return err
+	}
+
+	n = binary.PutUvarint(buf, uint64(len(cmd.Args)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	for _, arg := range cmd.Args {
+		n = binary.PutUvarint(buf, uint64(len(arg)))
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode implements Codec. Decoded arguments
+// do not retain references to data.
+func (BinaryCodec) Decode(data []byte, cmd *resp.Command) error {
+	name, data, err := readBinaryField(data)
+	if err != nil {
+		return err
+	}
+
+	u, n := binary.Uvarint(data)
+	if n <= 0 || u > uint64(len(data)) {
+		return errInvalidLogEntry
+	}
+	data = data[n:]
+
+	// copy remaining data to detach args from the log entry
+	data = append(make([]byte, 0, len(data)), data...)
+
+	cmd.Name = string(name)
+	cmd.Args = make([]resp.CommandArgument, int(u))
+	for i := range cmd.Args {
+		if cmd.Args[i], data, err = readBinaryField(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBinaryField(data []byte) ([]byte, []byte, error) {
+	u, n := binary.Uvarint(data)
+	if n <= 0 || u > uint64(len(data)-n) {
+		return nil, nil, errInvalidLogEntry
+	}
+	end := n + int(u)
+	return data[n:end:end], data[end:], nil
+}
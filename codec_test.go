@@ -0,0 +1,79 @@
+package planb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/bsm/redeo/resp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BinaryCodec", func() {
+	var subject = BinaryCodec{}
+
+	It("should encode/decode", func() {
+		buf := new(bytes.Buffer)
+		Expect(subject.Encode(buf, resp.NewCommand("SET", resp.CommandArgument("key"), resp.CommandArgument("value")))).To(Succeed())
+		Expect(buf.Len()).To(Equal(15))
+
+		var cmd resp.Command
+		Expect(subject.Decode(buf.Bytes(), &cmd)).To(Succeed())
+		Expect(cmd.Name).To(Equal("SET"))
+		Expect(cmd.Args).To(Equal([]resp.CommandArgument{
+			resp.CommandArgument("key"),
+			resp.CommandArgument("value"),
+		}))
+
+		Expect(subject.Decode(buf.Bytes()[:10], &cmd)).To(MatchError(errInvalidLogEntry))
+	})
+
+	It("should decode legacy log entries", func() {
+		buf := new(bytes.Buffer)
+		Expect(gob.NewEncoder(buf).Encode(resp.NewCommand("SET", resp.CommandArgument("key")))).To(Succeed())
+
+		var cmd resp.Command
+		Expect(decodeLogEntry(buf.Bytes(), subject, &cmd)).To(Succeed())
+		Expect(cmd.Name).To(Equal("SET"))
+		Expect(cmd.Args).To(Equal([]resp.CommandArgument{resp.CommandArgument("key")}))
+	})
+
+	It("should decode versioned log entries", func() {
+		buf := new(bytes.Buffer)
+		Expect(encodeLogEntry(buf, subject, resp.NewCommand("SET", resp.CommandArgument("key")))).To(Succeed())
+		Expect(buf.Bytes()[0]).To(Equal(logEntryCommand))
+
+		var cmd resp.Command
+		Expect(decodeLogEntry(buf.Bytes(), subject, &cmd)).To(Succeed())
+		Expect(cmd.Name).To(Equal("SET"))
+		Expect(cmd.Args).To(Equal([]resp.CommandArgument{resp.CommandArgument("key")}))
+	})
+
+	It("should encode/decode batch entries", func() {
+		buf := new(bytes.Buffer)
+		encodeCommandsEntry(buf, logEntryBatch, [][]byte{[]byte("cmd1"), []byte("command2")})
+		Expect(buf.Bytes()[0]).To(Equal(logEntryBatch))
+
+		Expect(decodeCommandsEntry(buf.Bytes()[1:])).To(Equal([][]byte{[]byte("cmd1"), []byte("command2")}))
+		_, err := decodeCommandsEntry(buf.Bytes()[1:8])
+		Expect(err).To(MatchError(errInvalidLogEntry))
+
+		var cmd resp.Command
+		Expect(decodeLogEntry(buf.Bytes(), subject, &cmd)).To(MatchError(errInvalidLogEntry))
+	})
+
+	It("should encode/decode stamps", func() {
+		buf := new(bytes.Buffer)
+		Expect(encodeLogStamp(buf)).To(Succeed())
+		buf.WriteString("rest")
+		Expect(buf.Bytes()[0]).To(Equal(logEntryStamped))
+
+		stamp, rest, err := decodeLogStamp(buf.Bytes()[1:])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stamp.Time).To(BeTemporally("~", time.Now(), time.Second))
+		Expect(stamp.Seed).NotTo(BeZero())
+		Expect(string(rest)).To(Equal("rest"))
+	})
+
+})
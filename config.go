@@ -1,6 +1,8 @@
 package planb
 
 import (
+	"time"
+
 	"github.com/bsm/redeoraft"
 	"github.com/hashicorp/raft"
 )
@@ -13,6 +15,114 @@ type Config struct {
 	// Transport configuration options
 	Transport *redeoraft.Config
 
+	// Codec is used to encode commands in the replicated log.
+	// All nodes of a cluster must use the same codec.
+	// Default: BinaryCodec
+	Codec Codec
+
+	// Batch configuration
+	Batch struct {
+		// MaxSize enables batching of concurrent mutating commands
+		// into a single log entry if > 1. It sets the maximum
+		// number of commands per batch. Default: 0 (disabled)
+		//
+		// Commands from different connections are coalesced, as
+		// are mutating commands which a single connection has
+		// pipelined back to back. Their replies retain the order.
+		MaxSize int
+		// Window is the maximum duration to wait for additional
+		// commands before a batch is applied. Default: 1ms
+		Window time.Duration
+	}
+
+	// Expiry configuration, only applies to stores
+	// which implement ExpiringStore
+	Expiry struct {
+		// SweepInterval is the interval at which the leader removes
+		// expired keys. Default: 1s
+		SweepInterval time.Duration
+		// SweepLimit is the maximum number of keys removed per
+		// sweep. Default: 1000
+		SweepLimit int
+	}
+
+	// Snapshot configuration
+	Snapshot struct {
+		// Compression sets the compression algorithm of new snapshots.
+		// Snapshots are restored regardless of their compression.
+		// Default: CompressionNone
+		Compression SnapshotCompression
+	}
+
+	// Cluster configuration
+	Cluster struct {
+		// Seeds are the advertised addresses of the initial cluster
+		// members. If set, nodes discover each other on start and
+		// bootstrap the cluster automatically, while new nodes ask
+		// the leader of an existing cluster to be added. All nodes
+		// should be configured with the same seeds. Only the seed
+		// with the lowest address bootstraps, it must be a voter.
+		// Default: nil (disabled, use RAFT BOOTSTRAP)
+		Seeds []string
+		// Expect is the number of voting nodes required to
+		// bootstrap a new cluster. Default: len(Seeds)
+		Expect int
+		// RetryInterval is the interval between discovery
+		// attempts. Default: 1s
+		RetryInterval time.Duration
+		// NonVoter makes the node join clusters as a non-voting
+		// member. Non-voters replicate the log, but never become
+		// leader and do not count towards the quorum, they can
+		// be used as read replicas. Default: false
+		NonVoter bool
+		// LeaderPriority is the priority of the node to become leader.
+		// The leader transfers leadership to the healthy voter with
+		// the highest priority, if it exceeds its own. Default: 0
+		LeaderPriority int
+		// PriorityCheckInterval is the interval at which the leader
+		// checks the priorities of all voters. Failed transfers are
+		// retried with an exponential backoff. Default: 10s
+		PriorityCheckInterval time.Duration
+	}
+
+	// Backup configuration
+	Backup struct {
+		// Target enables scheduled backups. While the node is the
+		// leader, the latest snapshot is periodically shipped to
+		// the target. Default: nil (disabled)
+		Target BackupTarget
+		// Interval is the interval between backups. Default: 1h
+		Interval time.Duration
+		// Retain is the number of backups to keep, older backups
+		// are removed from the target. Default: 24
+		Retain int
+	}
+
+	// Autopilot configuration
+	Autopilot struct {
+		// Interval is the interval at which the leader checks
+		// the health of all servers. Default: 1s
+		Interval time.Duration
+		// LastContactThreshold marks servers as unhealthy if the
+		// leader has not reached them for longer. Default: 10s
+		LastContactThreshold time.Duration
+		// MaxLagEntries marks servers as unhealthy if their log
+		// lags further behind the leader. Default: 1000
+		MaxLagEntries uint64
+		// CleanupDeadServers enables the removal of dead servers.
+		// Unhealthy servers are dead once the leader has not reached
+		// them for DeadServerGracePeriod, or as soon as a replacement
+		// with a new node ID is started at their address. Default: false
+		CleanupDeadServers bool
+		// DeadServerGracePeriod is the time after which unreachable
+		// servers are considered dead. Default: 1h
+		DeadServerGracePeriod time.Duration
+		// MinQuorum is the minimum number of voters, dead voters
+		// are never removed below it, unless they have been
+		// replaced. Default: 3
+		MinQuorum int
+	}
+
 	// Sentinel configuration
 	Sentinel struct {
 		// MasterName must be set to enable sentinel support
@@ -23,7 +133,8 @@ type Config struct {
 // NewConfig inits a default configuration
 func NewConfig() *Config {
 	return &Config{
-		Raft: raft.DefaultConfig(),
+		Raft:  raft.DefaultConfig(),
+		Codec: BinaryCodec{},
 	}
 }
 
@@ -31,5 +142,50 @@ func (c *Config) norm(fn string) error {
 	if c.Raft == nil {
 		c.Raft = raft.DefaultConfig()
 	}
+	if c.Codec == nil {
+		c.Codec = BinaryCodec{}
+	}
+	if c.Batch.Window <= 0 {
+		c.Batch.Window = time.Millisecond
+	}
+	if c.Expiry.SweepInterval <= 0 {
+		c.Expiry.SweepInterval = time.Second
+	}
+	if c.Expiry.SweepLimit <= 0 {
+		c.Expiry.SweepLimit = 1000
+	}
+	if c.Cluster.Expect <= 0 {
+		c.Cluster.Expect = len(c.Cluster.Seeds)
+	}
+	if c.Cluster.RetryInterval <= 0 {
+		c.Cluster.RetryInterval = time.Second
+	}
+	if c.Cluster.PriorityCheckInterval <= 0 {
+		c.Cluster.PriorityCheckInterval = 10 * time.Second
+	}
+	if c.Backup.Interval <= 0 {
+		c.Backup.Interval = time.Hour
+	}
+	if c.Backup.Retain <= 0 {
+		c.Backup.Retain = 24
+	}
+	if c.Autopilot.Interval <= 0 {
+		c.Autopilot.Interval = time.Second
+	}
+	if c.Autopilot.LastContactThreshold <= 0 {
+		c.Autopilot.LastContactThreshold = 10 * time.Second
+	}
+	if c.Autopilot.MaxLagEntries == 0 {
+		c.Autopilot.MaxLagEntries = 1000
+	}
+	if c.Autopilot.DeadServerGracePeriod <= 0 {
+		c.Autopilot.DeadServerGracePeriod = time.Hour
+	}
+	if c.Autopilot.MinQuorum <= 0 {
+		c.Autopilot.MinQuorum = 3
+	}
+	if c.Snapshot.Compression > CompressionZstd {
+		return errSnapshotCompression
+	}
 	return normNodeID(c.Raft, fn)
 }
@@ -0,0 +1,70 @@
+package planb
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// expirySweeper periodically removes expired keys
+// from the store, while the node is the leader.
+type expirySweeper struct {
+	ctrl  *raft.Raft
+	store ExpiringStore
+	limit int
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newExpirySweeper(ctrl *raft.Raft, store ExpiringStore, interval time.Duration, limit int) *expirySweeper {
+	s := &expirySweeper{
+		ctrl:    ctrl,
+		store:   store,
+		limit:   limit,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go s.loop(interval)
+	return s
+}
+
+// Close stops the sweeper.
+func (s *expirySweeper) Close() error {
+	close(s.closing)
+	<-s.closed
+	return nil
+}
+
+func (s *expirySweeper) loop(interval time.Duration) {
+	defer close(s.closed)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			if s.ctrl.State() == raft.Leader {
+				_ = s.sweep()
+			}
+		}
+	}
+}
+
+func (s *expirySweeper) sweep() error {
+	keys := s.store.ExpiredKeys(time.Now(), s.limit)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := encodeLogStamp(buf); err != nil {
+		return err
+	}
+	encodeCommandsEntry(buf, logEntryExpire, keys)
+	return s.ctrl.Apply(buf.Bytes(), 0).Error()
+}
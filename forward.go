@@ -0,0 +1,285 @@
+package planb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bsm/pool"
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/client"
+	"github.com/bsm/redeo/resp"
+	"github.com/hashicorp/raft"
+)
+
+var (
+	errNoLeader    = errors.New("no known leader")
+	errForwardLoop = errors.New("command was already forwarded")
+)
+
+type ctxKeyForwarder struct{}
+
+// leaderForwarder proxies commands to the current raft leader
+type leaderForwarder struct {
+	pools map[raft.ServerAddress]*forwardPool
+	mu    sync.Mutex
+}
+
+// forwardPool is a connection pool which is closed once it has been
+// evicted and all forwards which are using it have finished.
+type forwardPool struct {
+	*client.Pool
+	refs    int
+	evicted bool
+}
+
+func newLeaderForwarder() *leaderForwarder {
+	return &leaderForwarder{pools: make(map[raft.ServerAddress]*forwardPool)}
+}
+
+// Forward sends the command to the leader and copies the
+// leader's reply to w.
+func (f *leaderForwarder) Forward(leader raft.ServerAddress, w resp.ResponseWriter, c *resp.Command, timeout time.Duration) error {
+	return f.ForwardAll(leader, w, c, []*resp.Command{c}, timeout)
+}
+
+// ForwardAll sends a sequence of commands on behalf of c to the leader,
+// over a single connection, and copies the reply to the last command to w.
+func (f *leaderForwarder) ForwardAll(leader raft.ServerAddress, w resp.ResponseWriter, c *resp.Command, cmds []*resp.Command, timeout time.Duration) error {
+	if leader == "" {
+		return errNoLeader
+	} else if isForwarded(c) {
+		return errForwardLoop
+	}
+
+	pool, err := f.fetch(leader)
+	if err != nil {
+		return err
+	}
+	defer f.release(pool)
+
+	cn, err := pool.Get()
+	if err != nil {
+		return err
+	}
+	defer pool.Put(cn)
+
+	if err := cn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		cn.MarkFailed()
+		return err
+	}
+
+	for _, cmd := range cmds {
+		args := make([][]byte, len(cmd.Args))
+		for i, arg := range cmd.Args {
+			args[i] = arg
+		}
+		cn.WriteCmd(cmd.Name, args...)
+	}
+	if err := cn.Flush(); err != nil {
+		cn.MarkFailed()
+		return err
+	}
+
+	// buffer the reply, partial replies must never reach the client
+	var reply interface{}
+	for range cmds {
+		if reply, err = readResponse(cn); err != nil {
+			cn.MarkFailed()
+			return err
+		}
+	}
+	if err := cn.SetDeadline(time.Time{}); err != nil {
+		cn.MarkFailed()
+	}
+	appendResponse(w, reply)
+	return nil
+}
+
+// Close closes all open connections.
+func (f *leaderForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	for addr, pool := range f.pools {
+		if e := f.evict(addr, pool); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// fetch returns the pool for addr, it must be released after use.
+func (f *leaderForwarder) fetch(addr raft.ServerAddress) (*forwardPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pool, ok := f.pools[addr]; ok {
+		pool.refs++
+		return pool, nil
+	}
+
+	// the leader has changed, evict pools of previous leaders
+	for other, pool := range f.pools {
+		_ = f.evict(other, pool)
+	}
+
+	cp, err := client.New(&pool.Options{InitialSize: 1}, func() (net.Conn, error) {
+		return dialForwarder(addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &forwardPool{Pool: cp, refs: 1}
+	f.pools[addr] = pool
+	return pool, nil
+}
+
+// release releases a pool, evicted pools are closed after their last use.
+func (f *leaderForwarder) release(pool *forwardPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pool.refs--; pool.evicted && pool.refs == 0 {
+		_ = pool.Close()
+	}
+}
+
+// evict removes a pool, it is closed immediately unless it is in use.
+// Requires a lock.
+func (f *leaderForwarder) evict(addr raft.ServerAddress, pool *forwardPool) error {
+	delete(f.pools, addr)
+	pool.evicted = true
+	if pool.refs == 0 {
+		return pool.Close()
+	}
+	return nil
+}
+
+// dialForwarder connects to addr and marks the connection
+// as a forwarding connection, see RAFT FORWARDER.
+func dialForwarder(addr raft.ServerAddress) (net.Conn, error) {
+	cn, err := net.DialTimeout("tcp", string(addr), sendCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := markForwarder(cn); err != nil {
+		_ = cn.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+func markForwarder(cn net.Conn) error {
+	if err := cn.SetDeadline(time.Now().Add(sendCommandTimeout)); err != nil {
+		return err
+	}
+
+	w := resp.NewRequestWriter(cn)
+	w.WriteCmdString("RAFT", "FORWARDER")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	r := resp.NewResponseReader(cn)
+	if typ, err := r.PeekType(); err != nil {
+		return err
+	} else if typ == resp.TypeError {
+		msg, err := r.ReadError()
+		if err == nil {
+			err = errors.New(msg)
+		}
+		return err
+	}
+	if _, err := r.ReadInlineString(); err != nil {
+		return err
+	}
+	return cn.SetDeadline(time.Time{})
+}
+
+// forwarder marks the client connection as a forwarding connection from
+// another node. Commands received via forwarding connections are never
+// forwarded again, which prevents loops while nodes disagree on the leader.
+func forwarder(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 0 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	if cl := redeo.GetClient(c.Context()); cl != nil {
+		cl.SetContext(context.WithValue(cl.Context(), ctxKeyForwarder{}, true))
+	}
+	w.AppendOK()
+}
+
+// isForwarded returns true if c was received via a forwarding connection.
+func isForwarded(c *resp.Command) bool {
+	cl := redeo.GetClient(c.Context())
+	return cl != nil && cl.Context().Value(ctxKeyForwarder{}) != nil
+}
+
+type (
+	inlineReply string
+	errorReply  string
+)
+
+// readResponse reads a single, complete response from r.
+func readResponse(r resp.ResponseParser) (interface{}, error) {
+	typ, err := r.PeekType()
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case resp.TypeArray:
+		n, err := r.ReadArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		vals := make([]interface{}, n)
+		for i := range vals {
+			if vals[i], err = readResponse(r); err != nil {
+				return nil, err
+			}
+		}
+		return vals, nil
+	case resp.TypeBulk:
+		return r.ReadBulk(nil)
+	case resp.TypeInline:
+		s, err := r.ReadInlineString()
+		return inlineReply(s), err
+	case resp.TypeError:
+		s, err := r.ReadError()
+		return errorReply(s), err
+	case resp.TypeInt:
+		return r.ReadInt()
+	case resp.TypeNil:
+		return nil, r.ReadNil()
+	}
+	return nil, errUnexpectedServerResponse
+}
+
+// appendResponse appends a response, as read by readResponse, to w.
+func appendResponse(w resp.ResponseWriter, v interface{}) {
+	switch v := v.(type) {
+	case []interface{}:
+		w.AppendArrayLen(len(v))
+		for _, x := range v {
+			appendResponse(w, x)
+		}
+	case []byte:
+		w.AppendBulk(v)
+	case inlineReply:
+		w.AppendInlineString(string(v))
+	case errorReply:
+		w.AppendError(string(v))
+	case int64:
+		w.AppendInt(v)
+	default:
+		w.AppendNil()
+	}
+}
@@ -0,0 +1,129 @@
+package planb
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/resp"
+	"github.com/hashicorp/raft"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("leaderForwarder", func() {
+	var subject *leaderForwarder
+	var listeners []net.Listener
+	var addrs []raft.ServerAddress
+
+	BeforeEach(func() {
+		subject = newLeaderForwarder()
+		listeners, addrs = nil, nil
+
+		for i := 0; i < 2; i++ {
+			lis, err := net.Listen("tcp", "127.0.0.1:")
+			Expect(err).NotTo(HaveOccurred())
+			listeners = append(listeners, lis)
+			addrs = append(addrs, raft.ServerAddress(lis.Addr().String()))
+
+			srv := redeo.NewServer(nil)
+			srv.Handle("ping", redeo.Ping())
+			srv.Handle("raft", redeo.SubCommands{"forwarder": redeo.HandlerFunc(forwarder)})
+			srv.Handle("fwd", redeo.HandlerFunc(func(w resp.ResponseWriter, c *resp.Command) {
+				if err := subject.Forward(addrs[1], w, resp.NewCommand("PING"), time.Second); err != nil {
+					w.AppendError("ERR " + err.Error())
+				}
+			}))
+			srv.Handle("fwdctx", redeo.HandlerFunc(func(w resp.ResponseWriter, c *resp.Command) {
+				cmd := resp.NewCommand("PING")
+				cmd.SetContext(c.Context())
+				if err := subject.Forward(addrs[1], w, cmd, time.Second); err != nil {
+					w.AppendError("ERR " + err.Error())
+				}
+			}))
+			go srv.Serve(lis)
+		}
+	})
+
+	AfterEach(func() {
+		Expect(subject.Close()).To(Succeed())
+		for _, lis := range listeners {
+			Expect(lis.Close()).To(Succeed())
+		}
+	})
+
+	var forward = func(addr raft.ServerAddress, name string) (string, error) {
+		buf := new(bytes.Buffer)
+		w := resp.NewResponseWriter(buf)
+		if err := subject.Forward(addr, w, resp.NewCommand(name), time.Second); err != nil {
+			return "", err
+		}
+		if err := w.Flush(); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	It("should forward commands", func() {
+		Expect(forward(addrs[0], "PING")).To(Equal("$4\r\nPONG\r\n"))
+		_, err := forward("", "PING")
+		Expect(err).To(MatchError(errNoLeader))
+	})
+
+	It("should evict pools of previous leaders", func() {
+		Expect(forward(addrs[0], "PING")).To(Equal("$4\r\nPONG\r\n"))
+		Expect(subject.pools).To(HaveLen(1))
+		Expect(subject.pools).To(HaveKey(addrs[0]))
+
+		Expect(forward(addrs[1], "PING")).To(Equal("$4\r\nPONG\r\n"))
+		Expect(subject.pools).To(HaveLen(1))
+		Expect(subject.pools).To(HaveKey(addrs[1]))
+	})
+
+	It("should keep evicted pools open until their last use", func() {
+		pool, err := subject.fetch(addrs[0])
+		Expect(err).NotTo(HaveOccurred())
+		cn, err := pool.Get()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(forward(addrs[1], "PING")).To(Equal("$4\r\nPONG\r\n"))
+		Expect(subject.pools).NotTo(HaveKey(addrs[0]))
+		Expect(pool.evicted).To(BeTrue())
+
+		cn.WriteCmdString("PING")
+		Expect(cn.Flush()).To(Succeed())
+		Expect(cn.ReadBulkString()).To(Equal("PONG"))
+		pool.Put(cn)
+
+		subject.release(pool)
+		Expect(pool.refs).To(Equal(0))
+	})
+
+	It("should not forward commands twice", func() {
+		Expect(forward(addrs[0], "FWD")).To(Equal("$4\r\nPONG\r\n"))
+		Expect(forward(addrs[0], "FWDCTX")).To(Equal("-ERR command was already forwarded\r\n"))
+	})
+})
+
+var _ = Describe("readResponse", func() {
+	var read = func(s string) (interface{}, error) {
+		return readResponse(resp.NewResponseReader(bytes.NewBufferString(s)))
+	}
+
+	It("should buffer complete responses", func() {
+		reply, err := read("*3\r\n$3\r\nfoo\r\n*2\r\n:1\r\n$-1\r\n-ERR bad\r\n")
+		Expect(err).NotTo(HaveOccurred())
+
+		buf := new(bytes.Buffer)
+		w := resp.NewResponseWriter(buf)
+		appendResponse(w, reply)
+		Expect(w.Flush()).To(Succeed())
+		Expect(buf.String()).To(Equal("*3\r\n$3\r\nfoo\r\n*2\r\n:1\r\n$-1\r\n-ERR bad\r\n"))
+	})
+
+	It("should fail on truncated responses", func() {
+		_, err := read("*3\r\n$3\r\nfoo\r\n:1\r\n")
+		Expect(err).To(HaveOccurred())
+	})
+})
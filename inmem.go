@@ -5,43 +5,100 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var errInvalidStorageKey = errors.New("planb: invalid storage key")
+var (
+	errInvalidStorageKey     = errors.New("planb: invalid storage key")
+	errInvalidSnapshotFormat = errors.New("planb: invalid snapshot format")
+	errNotOrdered            = errors.New("planb: store has no ordered index")
+	errInvalidScore          = errors.New("planb: invalid score")
+)
 
 const numInMemShards = 64
 
+// snapshots start with an empty key, followed by a version
+// byte. Legacy snapshots have no header. Records of v2 snapshots
+// include a value type.
+const (
+	inMemSnapshotV1 byte = 1
+	inMemSnapshotV2 byte = 2
+)
+
 type InmemStore struct {
-	shards [numInMemShards]*inMemShard
+	shards  atomic.Value // *inMemShards
+	ordered bool
 }
 
 // NewInmemStore opens a new simplistic, non-transactional in-memory KVStore
 func NewInmemStore() *InmemStore {
 	store := new(InmemStore)
-	for i := 0; i < numInMemShards; i++ {
-		store.shards[i] = &inMemShard{data: make(map[string][]byte)}
-	}
+	store.shards.Store(newInMemShards(false))
 	return store
 }
 
-// Get retrieves a key
+// NewOrderedInmemStore opens a new in-memory KVStore, which additionally
+// maintains an ordered index of all keys. Scans return keys in lexicographical
+// order and range queries are supported, at the cost of slower writes.
+func NewOrderedInmemStore() *InmemStore {
+	store := &InmemStore{ordered: true}
+	store.shards.Store(newInMemShards(true))
+	return store
+}
+
+// Get retrieves a key. Keys which have expired
+// according to the local clock are not returned.
+// Returns ErrWrongType if the key holds a typed value.
 func (s *InmemStore) Get(key []byte) ([]byte, error) {
+	return s.GetAt(key, time.Now())
+}
+
+// GetAt retrieves a key, unless it has expired at the given time. Mutating
+// handlers should pass LogMeta.Time to produce consistent results on all nodes.
+func (s *InmemStore) GetAt(key []byte, now time.Time) ([]byte, error) {
 	if len(key) == 0 {
 		return nil, errInvalidStorageKey
 	}
 
-	val := s.shards[fnv32a(key)%numInMemShards].Get(key)
-	return val, nil
+	return s.shard(key).Get(key, now.UnixNano())
 }
 
-// Put sets a key
+// Put sets a key, replacing any existing value
 func (s *InmemStore) Put(key, val []byte) error {
+	return s.put(key, val, 0)
+}
+
+// PutWithTTL sets a key which expires after ttl. The expiration is calculated
+// relative to now, which should be LogMeta.Time to produce consistent results
+// on all nodes.
+func (s *InmemStore) PutWithTTL(key, val []byte, ttl time.Duration, now time.Time) error {
+	if ttl <= 0 {
+		return s.Delete(key)
+	}
+	return s.put(key, val, now.Add(ttl).UnixNano())
+}
+
+// Expire sets the expiration of an existing key of any type to ttl, relative
+// to now. A ttl <= 0 deletes the key. Returns false if the key does not exist.
+func (s *InmemStore) Expire(key []byte, ttl time.Duration, now time.Time) (bool, error) {
 	if len(key) == 0 {
-		return errInvalidStorageKey
+		return false, errInvalidStorageKey
 	}
-	s.shards[fnv32a(key)%numInMemShards].Put(key, val)
-	return nil
+	return s.shard(key).Expire(key, ttl, now.UnixNano()), nil
+}
+
+// TTL returns the remaining time to live of a key at the given time. It
+// returns -1 if the key exists but has no associated expiration and -2
+// if the key does not exist.
+func (s *InmemStore) TTL(key []byte, now time.Time) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, errInvalidStorageKey
+	}
+	return s.shard(key).TTL(key, now.UnixNano()), nil
 }
 
 // Delete deletes a key
@@ -49,20 +106,205 @@ func (s *InmemStore) Delete(key []byte) error {
 	return s.Put(key, nil)
 }
 
+// Scan iterates over keys with the given prefix. It returns up to count keys
+// following cursor and the cursor for the next call, which is nil once the
+// iteration is complete. Pass a nil cursor to start a new iteration. Keys
+// which exist throughout a full iteration are returned exactly once.
+//
+// Keys are returned in lexicographical order if the store maintains an
+// ordered index, otherwise they are only ordered within their shards.
+func (s *InmemStore) Scan(cursor, prefix []byte, count int) ([][]byte, []byte, error) {
+	if count < 1 {
+		count = 10
+	}
+
+	shards := s.load()
+	now := time.Now().UnixNano()
+	if index := shards.Index(); index != nil {
+		start := string(prefix)
+		if len(cursor) != 0 && string(cursor) >= start {
+			start = string(cursor) + "\x00"
+		}
+		return shards.AppendIndexed(nil, index, start, count, now, func(key string) bool {
+			return !strings.HasPrefix(key, string(prefix))
+		})
+	}
+
+	var keys [][]byte
+	pos, after := 0, ""
+	if len(cursor) != 0 {
+		pos, after = shards.Pos(cursor), string(cursor)
+	}
+	for ; pos < numInMemShards; pos++ {
+		found := shards[pos].Keys(after, string(prefix), now, count-len(keys)+1)
+		if n := count - len(keys); len(found) > n {
+			keys = append(keys, found[:n]...)
+			return keys, keys[len(keys)-1], nil
+		}
+		keys = append(keys, found...)
+		after = ""
+	}
+	return keys, nil, nil
+}
+
+// Range returns up to count keys within the [start, end) range in
+// lexicographical order. A nil end is unbounded. It requires an ordered
+// index, see NewOrderedInmemStore.
+func (s *InmemStore) Range(start, end []byte, count int) ([][]byte, error) {
+	if count < 1 {
+		count = 10
+	}
+
+	shards := s.load()
+	index := shards.Index()
+	if index == nil {
+		return nil, errNotOrdered
+	}
+
+	keys, _, err := shards.AppendIndexed(nil, index, string(start), count, time.Now().UnixNano(), func(key string) bool {
+		return end != nil && key >= string(end)
+	})
+	return keys, err
+}
+
+// ExpiredKeys implements ExpiringStore
+func (s *InmemStore) ExpiredKeys(now time.Time, limit int) [][]byte {
+	var keys [][]byte
+	shards := s.load()
+	for i := 0; i < numInMemShards && len(keys) < limit; i++ {
+		keys = shards[i].AppendExpired(keys, now.UnixNano(), limit)
+	}
+	return keys
+}
+
+// DeleteExpired implements ExpiringStore
+func (s *InmemStore) DeleteExpired(keys [][]byte, now time.Time) error {
+	for _, key := range keys {
+		if len(key) == 0 {
+			return errInvalidStorageKey
+		}
+		s.shard(key).DeleteExpired(key, now.UnixNano())
+	}
+	return nil
+}
+
 // Snapshot implements Store
 func (s *InmemStore) Snapshot(w io.Writer) error {
-	buf := make([]byte, binary.MaxVarintLen64)
+	snap, err := s.Freeze()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return snap.Persist(w)
+}
+
+// Freeze implements Snapshotter. Frozen shards are
+// copied on write, no locks are held while the snapshot
+// is persisted.
+func (s *InmemStore) Freeze() (StoreSnapshot, error) {
+	shards := s.load()
+	snap := new(inMemSnapshot)
 	for i := 0; i < numInMemShards; i++ {
-		if err := s.shards[i].Snapshot(buf, w); err != nil {
+		snap.shards[i] = shards[i].Freeze()
+	}
+	return snap, nil
+}
+
+// Restore implements Store. The current state is replaced atomically,
+// concurrent readers see either the old or the new state.
+func (s *InmemStore) Restore(r io.Reader) error {
+	shards := newInMemShards(s.ordered)
+	snap := &inMemSnapshotIterator{Reader: bufio.NewReader(r)}
+	if err := snap.ReadHeader(); err != nil && err != io.EOF {
+		return err
+	} else if err == nil {
+		if err := shards.Load(snap); err != nil {
 			return err
 		}
 	}
+
+	s.shards.Store(shards)
 	return nil
 }
 
-// Restore implements Store
-func (s *InmemStore) Restore(r io.Reader) error {
-	snap := &inMemSnapshotIterator{Reader: bufio.NewReader(r)}
+func (s *InmemStore) load() *inMemShards {
+	return s.shards.Load().(*inMemShards)
+}
+
+func (s *InmemStore) shard(key []byte) *inMemShard {
+	return s.load().Shard(key)
+}
+
+func (s *InmemStore) put(key, val []byte, exp int64) error {
+	if len(key) == 0 {
+		return errInvalidStorageKey
+	}
+	s.shard(key).Put(key, val, exp)
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+type inMemShards [numInMemShards]*inMemShard
+
+func newInMemShards(ordered bool) *inMemShards {
+	var index *keyIndex
+	if ordered {
+		index = newKeyIndex()
+	}
+
+	shards := new(inMemShards)
+	for i := 0; i < numInMemShards; i++ {
+		shards[i] = &inMemShard{
+			data:  make(map[string]interface{}),
+			exps:  make(map[string]int64),
+			index: index,
+		}
+	}
+	return shards
+}
+
+func (ss *inMemShards) Shard(key []byte) *inMemShard {
+	return ss[ss.Pos(key)]
+}
+
+// Pos returns the position of the shard for key.
+func (ss *inMemShards) Pos(key []byte) int {
+	return int(fnv32a(key) % numInMemShards)
+}
+
+// Index returns the ordered key index, shared
+// by all shards. Returns nil if unordered.
+func (ss *inMemShards) Index() *keyIndex {
+	return ss[0].index
+}
+
+// AppendIndexed appends up to count unexpired keys >= start from the index,
+// until stop returns true. It returns the last appended key as a cursor,
+// if more keys may follow.
+func (ss *inMemShards) AppendIndexed(keys [][]byte, index *keyIndex, start string, count int, now int64, stop func(string) bool) ([][]byte, []byte, error) {
+	for {
+		limit := count - len(keys)
+		found := index.Keys(start, limit, stop)
+		for _, key := range found {
+			if ss.Shard([]byte(key)).Exists(key, now) {
+				keys = append(keys, []byte(key))
+			}
+		}
+
+		switch {
+		case len(found) < limit:
+			return keys, nil, nil
+		case len(keys) == count:
+			return keys, keys[len(keys)-1], nil
+		}
+		start = found[len(found)-1] + "\x00"
+	}
+}
+
+// Load loads all records from a snapshot.
+func (ss *inMemShards) Load(snap *inMemSnapshotIterator) error {
 	for {
 		err := snap.Next()
 		if err == io.EOF {
@@ -70,85 +312,459 @@ func (s *InmemStore) Restore(r io.Reader) error {
 		} else if err != nil {
 			return err
 		}
-		if err := s.Put(snap.key, snap.val); err != nil {
-			return err
+		if len(snap.key) == 0 {
+			return errInvalidStorageKey
 		}
+		ss.Shard(snap.key).Load(snap.key, snap.val, snap.exp)
 	}
 }
 
 // --------------------------------------------------------------------
 
 type inMemShard struct {
-	data map[string][]byte
+	data map[string]interface{} // either []byte or inMemContainer
+	exps map[string]int64       // expiration times (unix nanos)
 	mu   sync.RWMutex
+
+	frozen bool      // true if data is referenced by a snapshot
+	epoch  uint64    // incremented on each freeze
+	index  *keyIndex // optional, ordered index of keys across all shards
+	sorted []string  // sorted keys, nil when keys were added or removed
+}
+
+// Freeze marks the shard as frozen and returns its current state.
+func (s *inMemShard) Freeze() inMemShardView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.frozen = true
+	s.epoch++
+	return inMemShardView{data: s.data, exps: s.exps}
+}
+
+// thaw copies frozen data, must be called before
+// any modifications. Requires a write lock.
+func (s *inMemShard) thaw() {
+	if !s.frozen {
+		return
+	}
+
+	data := make(map[string]interface{}, len(s.data))
+	for key, val := range s.data {
+		data[key] = val
+	}
+	exps := make(map[string]int64, len(s.exps))
+	for key, exp := range s.exps {
+		exps[key] = exp
+	}
+	s.data, s.exps, s.frozen = data, exps, false
 }
 
-func (s *inMemShard) Snapshot(buf []byte, w io.Writer) error {
+func (s *inMemShard) Get(key []byte, now int64) ([]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for key, val := range s.data {
-		n := binary.PutUvarint(buf[:binary.MaxVarintLen64], uint64(len(key)))
-		if _, err := w.Write(buf[:n]); err != nil {
-			return err
+	val, ok := s.data[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	if exp, ok := s.exps[string(key)]; ok && exp <= now {
+		return nil, nil
+	}
+	if b, ok := val.([]byte); ok {
+		return b, nil
+	}
+	return nil, ErrWrongType
+}
+
+// Type returns the type of the value at key.
+func (s *inMemShard) Type(key []byte, now int64) (byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	val, ok := s.data[string(key)]
+	if !ok {
+		return 0, false
+	}
+	if exp, ok := s.exps[string(key)]; ok && exp <= now {
+		return 0, false
+	}
+	if c, ok := val.(inMemContainer); ok {
+		return c.Type(), true
+	}
+	return inMemTypeString, true
+}
+
+// View calls fn with the container at key, unless it is missing
+// or expired. Returns ErrWrongType if the value is of a different type.
+func (s *inMemShard) View(key []byte, typ byte, now int64, fn func(inMemContainer)) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	val, ok := s.data[string(key)]
+	if !ok {
+		return nil
+	}
+	if exp, ok := s.exps[string(key)]; ok && exp <= now {
+		return nil
+	}
+	c, ok := val.(inMemContainer)
+	if !ok || c.Type() != typ {
+		return ErrWrongType
+	}
+	fn(c)
+	return nil
+}
+
+// Modify calls fn with the container at key. Missing containers are created
+// if create is true, otherwise fn is not called. Containers which are empty
+// after the modification are removed. Values which have expired at now are
+// treated as missing. Returns ErrWrongType if the value is of a different type.
+func (s *inMemShard) Modify(key []byte, typ byte, create bool, now int64, fn func(inMemContainer)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var c inMemContainer
+	val, ok := s.data[string(key)]
+	exp, expires := s.exps[string(key)]
+	expired := ok && expires && exp <= now
+	if expired {
+		ok = false
+	}
+
+	if ok {
+		if c, ok = val.(inMemContainer); !ok || c.Type() != typ {
+			return ErrWrongType
 		}
-		if _, err := io.WriteString(w, key); err != nil {
-			return err
+	} else if !create {
+		return nil
+	}
+
+	s.thaw()
+	if expired {
+		s.delete(string(key))
+	}
+	if c == nil {
+		c = newInMemContainer(typ, s.epoch)
+		s.data[string(key)] = c
+		s.sorted = nil
+		if s.index != nil {
+			s.index.Insert(string(key))
 		}
+	} else if c.Epoch() != s.epoch {
+		c = c.Clone(s.epoch)
+		s.data[string(key)] = c
+	}
 
-		n = binary.PutUvarint(buf[:binary.MaxVarintLen64], uint64(len(val)))
-		if _, err := w.Write(buf[:n]); err != nil {
-			return err
+	fn(c)
+	if c.Len() == 0 {
+		s.delete(string(key))
+	}
+	return nil
+}
+
+func (s *inMemShard) Exists(key string, now int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.data[key]; !ok {
+		return false
+	}
+	exp, ok := s.exps[key]
+	return !ok || exp > now
+}
+
+// Keys returns up to limit unexpired keys with the given prefix,
+// which are greater than after, in lexicographical order.
+func (s *inMemShard) Keys(after, prefix string, now int64, limit int) [][]byte {
+	sorted := s.sortedKeys()
+
+	start := prefix
+	if after >= start {
+		start = after + "\x00"
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys [][]byte
+	for i := sort.SearchStrings(sorted, start); i < len(sorted) && len(keys) < limit; i++ {
+		key := sorted[i]
+		if !strings.HasPrefix(key, prefix) {
+			break
 		}
-		if _, err := w.Write(val); err != nil {
-			return err
+		if _, ok := s.data[key]; !ok {
+			continue
+		}
+		if exp, ok := s.exps[key]; ok && exp <= now {
+			continue
 		}
+		keys = append(keys, []byte(key))
 	}
-	return nil
+	return keys
 }
 
-func (s *inMemShard) Get(key []byte) []byte {
+// sortedKeys returns the sorted keys of the shard. The slice is cached
+// until keys are added or removed and must not be modified.
+func (s *inMemShard) sortedKeys() []string {
 	s.mu.RLock()
-	val := s.data[string(key)]
+	sorted := s.sorted
 	s.mu.RUnlock()
-	return val
+	if sorted != nil {
+		return sorted
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sorted == nil {
+		sorted := make([]string, 0, len(s.data))
+		for key := range s.data {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		s.sorted = sorted
+	}
+	return s.sorted
 }
 
-func (s *inMemShard) Put(key, val []byte) {
+func (s *inMemShard) TTL(key []byte, now int64) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.data[string(key)]; !ok {
+		return -2
+	}
+
+	exp, ok := s.exps[string(key)]
+	if !ok {
+		return -1
+	} else if exp <= now {
+		return -2
+	}
+	return time.Duration(exp - now)
+}
+
+func (s *inMemShard) Expire(key []byte, ttl time.Duration, now int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, ok := s.data[string(key)]
+	if !ok {
+		return false
+	} else if exp, ok := s.exps[string(key)]; ok && exp <= now {
+		return false
+	}
+
+	s.thaw()
+	if ttl <= 0 {
+		s.delete(string(key))
+	} else {
+		s.set(string(key), val, now+int64(ttl))
+	}
+	return true
+}
+
+func (s *inMemShard) Put(key, val []byte, exp int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.thaw()
 
 	if val == nil {
-		delete(s.data, string(key))
+		s.delete(string(key))
+		return
+	}
+	s.set(string(key), val, exp)
+}
+
+// Load stores a value loaded from a snapshot.
+func (s *inMemShard) Load(key []byte, val interface{}, exp int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.set(string(key), val, exp)
+}
+
+// set sets a value, requires a write lock.
+func (s *inMemShard) set(key string, val interface{}, exp int64) {
+	if s.index != nil {
+		s.index.Insert(key)
+	}
+	if _, ok := s.data[key]; !ok {
+		s.sorted = nil
+	}
+	s.data[key] = val
+	if exp != 0 {
+		s.exps[key] = exp
 	} else {
-		s.data[string(key)] = val
+		delete(s.exps, key)
+	}
+}
+
+// delete deletes a value, requires a write lock.
+func (s *inMemShard) delete(key string) {
+	if _, ok := s.data[key]; ok {
+		s.sorted = nil
+	}
+	delete(s.data, key)
+	delete(s.exps, key)
+	if s.index != nil {
+		s.index.Delete(key)
+	}
+}
+
+func (s *inMemShard) AppendExpired(keys [][]byte, now int64, limit int) [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for key, exp := range s.exps {
+		if len(keys) >= limit {
+			break
+		}
+		if exp <= now {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys
+}
+
+func (s *inMemShard) DeleteExpired(key []byte, now int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if exp, ok := s.exps[string(key)]; ok && exp <= now {
+		s.thaw()
+		s.delete(string(key))
+	}
+}
+
+// --------------------------------------------------------------------
+
+type inMemShardView struct {
+	data map[string]interface{}
+	exps map[string]int64
+}
+
+func (v inMemShardView) Persist(buf []byte, w io.Writer) error {
+	for key, val := range v.data {
+		if err := writeSnapshotField(buf, w, []byte(key)); err != nil {
+			return err
+		}
+
+		switch val := val.(type) {
+		case inMemContainer:
+			if _, err := w.Write([]byte{val.Type()}); err != nil {
+				return err
+			}
+			if err := val.Encode(buf, w); err != nil {
+				return err
+			}
+		case []byte:
+			if _, err := w.Write([]byte{inMemTypeString}); err != nil {
+				return err
+			}
+			if err := writeSnapshotField(buf, w, val); err != nil {
+				return err
+			}
+		}
+
+		n := binary.PutVarint(buf[:binary.MaxVarintLen64], v.exps[key])
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inMemSnapshot is a frozen view of an InmemStore
+type inMemSnapshot struct {
+	shards [numInMemShards]inMemShardView
+}
+
+// Persist implements StoreSnapshot
+func (s *inMemSnapshot) Persist(w io.Writer) error {
+	if _, err := w.Write([]byte{0, inMemSnapshotV2}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	for i := 0; i < numInMemShards; i++ {
+		if err := s.shards[i].Persist(buf, w); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
+// Release implements StoreSnapshot
+func (s *inMemSnapshot) Release() {}
+
 // --------------------------------------------------------------------
 
 type inMemSnapshotIterator struct {
 	*bufio.Reader
-	key, val []byte
+	key []byte
+	val interface{}
+	exp int64
+
+	version byte
 }
 
-func (s *inMemSnapshotIterator) Next() error {
-	u, err := binary.ReadUvarint(s)
+// ReadHeader detects the snapshot format version
+func (s *inMemSnapshotIterator) ReadHeader() error {
+	b, err := s.Peek(1)
 	if err != nil {
 		return err
 	}
-	s.key = make([]byte, int(u))
-	if _, err := io.ReadFull(s, s.key); err != nil {
-		return err
+	if b[0] != 0 {
+		return nil // legacy format
 	}
 
-	u, err = binary.ReadUvarint(s)
-	if err != nil {
+	if _, err := s.Discard(1); err != nil {
+		return err
+	}
+	if s.version, err = s.ReadByte(); err != nil {
 		return err
 	}
-	s.val = make([]byte, int(u))
-	if _, err := io.ReadFull(s, s.val); err != nil {
+	if s.version != inMemSnapshotV1 && s.version != inMemSnapshotV2 {
+		return errInvalidSnapshotFormat
+	}
+	return nil
+}
+
+func (s *inMemSnapshotIterator) Next() error {
+	var err error
+	if s.key, err = readSnapshotField(s.Reader); err != nil {
 		return err
 	}
+
+	typ := inMemTypeString
+	if s.version >= inMemSnapshotV2 {
+		if typ, err = s.ReadByte(); err != nil {
+			return err
+		}
+	}
+
+	if typ == inMemTypeString {
+		if s.val, err = readSnapshotField(s.Reader); err != nil {
+			return err
+		}
+	} else {
+		c := newInMemContainer(typ, 0)
+		if c == nil {
+			return errInvalidSnapshotFormat
+		}
+		if err := c.Decode(s.Reader); err != nil {
+			return err
+		}
+		s.val = c
+	}
+
+	s.exp = 0
+	if s.version >= inMemSnapshotV1 {
+		if s.exp, err = binary.ReadVarint(s); err != nil {
+			return err
+		}
+	}
 	return nil
 }
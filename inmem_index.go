@@ -0,0 +1,105 @@
+package planb
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const keyIndexMaxLevel = 24
+
+// keyIndex is an ordered index of keys, implemented as a skip list.
+type keyIndex struct {
+	head  keyIndexNode
+	level int
+	rnd   *rand.Rand
+	mu    sync.RWMutex
+}
+
+type keyIndexNode struct {
+	key  string
+	next []*keyIndexNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  keyIndexNode{next: make([]*keyIndexNode, keyIndexMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Insert adds a key to the index, unless it is already present.
+func (x *keyIndex) Insert(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var prev [keyIndexMaxLevel]*keyIndexNode
+	if n := x.seek(key, prev[:]); n != nil && n.key == key {
+		return
+	}
+
+	level := 1
+	for level < keyIndexMaxLevel && x.rnd.Intn(4) == 0 {
+		level++
+	}
+	for ; x.level < level; x.level++ {
+		prev[x.level] = &x.head
+	}
+
+	node := &keyIndexNode{key: key, next: make([]*keyIndexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+}
+
+// Delete removes a key from the index.
+func (x *keyIndex) Delete(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var prev [keyIndexMaxLevel]*keyIndexNode
+	n := x.seek(key, prev[:])
+	if n == nil || n.key != key {
+		return
+	}
+
+	for i := range n.next {
+		prev[i].next[i] = n.next[i]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+}
+
+// Keys returns up to limit keys >= start, in order. It stops
+// at the first key for which stop returns true.
+func (x *keyIndex) Keys(start string, limit int, stop func(string) bool) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var keys []string
+	for n := x.seek(start, nil); n != nil && len(keys) < limit; n = n.next[0] {
+		if stop(n.key) {
+			break
+		}
+		keys = append(keys, n.key)
+	}
+	return keys
+}
+
+// seek returns the first node >= key. If prev is given, it is populated with
+// the last node < key on each level. Requires a lock.
+func (x *keyIndex) seek(key string, prev []*keyIndexNode) *keyIndexNode {
+	n := &x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		if prev != nil {
+			prev[i] = n
+		}
+	}
+	return n.next[0]
+}
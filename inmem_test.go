@@ -2,6 +2,10 @@ package planb_test
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
 
 	"github.com/bsm/planb"
 	. "github.com/onsi/ginkgo"
@@ -10,8 +14,10 @@ import (
 
 var _ = Describe("InmemStore", func() {
 	var subject *planb.InmemStore
+	var now time.Time
 
 	BeforeEach(func() {
+		now = time.Now()
 		subject = planb.NewInmemStore()
 		Expect(subject.Put([]byte("key1"), []byte("val1"))).To(Succeed())
 		Expect(subject.Put([]byte("key2"), []byte("val2"))).To(Succeed())
@@ -43,4 +49,312 @@ var _ = Describe("InmemStore", func() {
 		Expect(subject.Get([]byte("key3"))).To(Equal([]byte("val3")))
 	})
 
+	It("should PUT with TTL", func() {
+		now := time.Now()
+		Expect(subject.PutWithTTL([]byte("key5"), []byte("val5"), time.Minute, now)).To(Succeed())
+		Expect(subject.GetAt([]byte("key5"), now)).To(Equal([]byte("val5")))
+		Expect(subject.GetAt([]byte("key5"), now.Add(time.Minute))).To(BeNil())
+
+		Expect(subject.TTL([]byte("key5"), now)).To(Equal(time.Minute))
+		Expect(subject.TTL([]byte("key5"), now.Add(time.Minute))).To(Equal(time.Duration(-2)))
+		Expect(subject.TTL([]byte("key1"), now)).To(Equal(time.Duration(-1)))
+		Expect(subject.TTL([]byte("key9"), now)).To(Equal(time.Duration(-2)))
+
+		Expect(subject.Put([]byte("key5"), []byte("val5"))).To(Succeed())
+		Expect(subject.TTL([]byte("key5"), now)).To(Equal(time.Duration(-1)))
+	})
+
+	It("should expire keys of any type", func() {
+		now := time.Now()
+		Expect(subject.SAdd([]byte("set"), now, []byte("a"))).To(Equal(1))
+		Expect(subject.Expire([]byte("set"), time.Minute, now)).To(BeTrue())
+		Expect(subject.TTL([]byte("set"), now)).To(Equal(time.Minute))
+		Expect(subject.Expire([]byte("set"), time.Second, now.Add(time.Minute))).To(BeFalse())
+		Expect(subject.Expire([]byte("key9"), time.Minute, now)).To(BeFalse())
+
+		Expect(subject.Expire([]byte("key1"), 0, now)).To(BeTrue())
+		Expect(subject.Get([]byte("key1"))).To(BeNil())
+	})
+
+	It("should delete expired keys", func() {
+		now := time.Now()
+		Expect(subject.PutWithTTL([]byte("key1"), []byte("val1"), time.Second, now)).To(Succeed())
+		Expect(subject.PutWithTTL([]byte("key2"), []byte("val2"), time.Minute, now)).To(Succeed())
+		Expect(subject.ExpiredKeys(now, 10)).To(BeEmpty())
+		Expect(subject.ExpiredKeys(now.Add(time.Second), 10)).To(Equal([][]byte{[]byte("key1")}))
+		Expect(subject.ExpiredKeys(now.Add(time.Minute), 10)).To(ConsistOf(Equal([]byte("key1")), Equal([]byte("key2"))))
+		Expect(subject.ExpiredKeys(now.Add(time.Minute), 1)).To(HaveLen(1))
+
+		Expect(subject.DeleteExpired([][]byte{[]byte("key1"), []byte("key2")}, now.Add(time.Second))).To(Succeed())
+		Expect(subject.TTL([]byte("key1"), now)).To(Equal(time.Duration(-2)))
+		Expect(subject.TTL([]byte("key2"), now)).To(Equal(time.Minute))
+	})
+
+	It("should snapshot/restore TTLs", func() {
+		now := time.Now()
+		Expect(subject.PutWithTTL([]byte("key5"), []byte("val5"), time.Minute, now)).To(Succeed())
+
+		buf := new(bytes.Buffer)
+		Expect(subject.Snapshot(buf)).To(Succeed())
+
+		restored := planb.NewInmemStore()
+		Expect(restored.Restore(buf)).To(Succeed())
+		Expect(restored.Get([]byte("key1"))).To(Equal([]byte("val1")))
+		Expect(restored.TTL([]byte("key1"), now)).To(Equal(time.Duration(-1)))
+		Expect(restored.TTL([]byte("key5"), now)).To(Equal(time.Minute))
+	})
+
+	It("should replace state on restore", func() {
+		buf := new(bytes.Buffer)
+		Expect(subject.Snapshot(buf)).To(Succeed())
+		Expect(subject.Put([]byte("key5"), []byte("val5"))).To(Succeed())
+
+		Expect(subject.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-2]))).NotTo(Succeed())
+		Expect(subject.Get([]byte("key5"))).To(Equal([]byte("val5")))
+
+		Expect(subject.Restore(buf)).To(Succeed())
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val1")))
+		Expect(subject.Get([]byte("key5"))).To(BeNil())
+	})
+
+	It("should freeze point-in-time snapshots", func() {
+		snap, err := subject.Freeze()
+		Expect(err).NotTo(HaveOccurred())
+		defer snap.Release()
+
+		Expect(subject.Put([]byte("key1"), []byte("val9"))).To(Succeed())
+		Expect(subject.Delete([]byte("key2"))).To(Succeed())
+		Expect(subject.Put([]byte("key5"), []byte("val5"))).To(Succeed())
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val9")))
+
+		buf := new(bytes.Buffer)
+		Expect(snap.Persist(buf)).To(Succeed())
+
+		restored := planb.NewInmemStore()
+		Expect(restored.Restore(buf)).To(Succeed())
+		Expect(restored.Get([]byte("key1"))).To(Equal([]byte("val1")))
+		Expect(restored.Get([]byte("key2"))).To(Equal([]byte("val2")))
+		Expect(restored.Get([]byte("key5"))).To(BeNil())
+	})
+
+	It("should not block writes while persisting", func() {
+		snap, err := subject.Freeze()
+		Expect(err).NotTo(HaveOccurred())
+		defer snap.Release()
+
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- snap.Persist(pw); pw.Close() }()
+
+		Expect(pr.Read(make([]byte, 1))).To(Equal(1))
+		Expect(subject.Put([]byte("key1"), []byte("val9"))).To(Succeed())
+		Expect(subject.Put([]byte("key5"), []byte("val5"))).To(Succeed())
+		Expect(subject.Get([]byte("key1"))).To(Equal([]byte("val9")))
+
+		Expect(ioutil.ReadAll(pr)).NotTo(BeEmpty())
+		Expect(<-done).To(Succeed())
+	})
+
+	It("should restore legacy snapshots", func() {
+		restored := planb.NewInmemStore()
+		Expect(restored.Restore(bytes.NewReader([]byte("\x04key1\x04val1\x04key2\x04val2")))).To(Succeed())
+		Expect(restored.Get([]byte("key1"))).To(Equal([]byte("val1")))
+		Expect(restored.Get([]byte("key2"))).To(Equal([]byte("val2")))
+	})
+
+	It("should scan", func() {
+		for i := 0; i < 100; i++ {
+			Expect(subject.Put([]byte(fmt.Sprintf("pfx:%02d", i)), []byte("val"))).To(Succeed())
+		}
+		Expect(subject.PutWithTTL([]byte("pfx:xx"), []byte("val"), time.Millisecond, time.Now().Add(-time.Second))).To(Succeed())
+
+		keys := scanAll(subject, []byte("pfx:"), 7)
+		Expect(keys).To(HaveLen(100))
+		Expect(keys).To(ContainElement("pfx:42"))
+		Expect(keys).NotTo(ContainElement("pfx:xx"))
+		Expect(scanAll(subject, nil, 10)).To(HaveLen(104))
+
+		// keys are picked up after changes
+		Expect(subject.Delete([]byte("pfx:42"))).To(Succeed())
+		Expect(subject.Put([]byte("pfx:zz"), []byte("val"))).To(Succeed())
+		Expect(subject.HSet([]byte("pfx:hh"), []byte("f1"), []byte("v1"), now)).To(BeTrue())
+		keys = scanAll(subject, []byte("pfx:"), 7)
+		Expect(keys).To(HaveLen(101))
+		Expect(keys).NotTo(ContainElement("pfx:42"))
+		Expect(keys).To(ContainElement("pfx:zz"))
+		Expect(keys).To(ContainElement("pfx:hh"))
+	})
+
+	It("should store hashes", func() {
+		Expect(subject.HSet([]byte("hash"), []byte("f1"), []byte("v1"), now)).To(BeTrue())
+		Expect(subject.HSet([]byte("hash"), []byte("f2"), []byte("v2"), now)).To(BeTrue())
+		Expect(subject.HSet([]byte("hash"), []byte("f2"), []byte("v3"), now)).To(BeFalse())
+		Expect(subject.HGet([]byte("hash"), []byte("f2"))).To(Equal([]byte("v3")))
+		Expect(subject.HGet([]byte("hash"), []byte("f3"))).To(BeNil())
+		Expect(subject.HLen([]byte("hash"))).To(Equal(2))
+		Expect(subject.HGetAll([]byte("hash"))).To(Equal(map[string][]byte{"f1": []byte("v1"), "f2": []byte("v3")}))
+		Expect(subject.Type([]byte("hash"))).To(Equal("hash"))
+
+		Expect(subject.HDel([]byte("hash"), now, []byte("f1"), []byte("f2"), []byte("f3"))).To(Equal(2))
+		Expect(subject.Type([]byte("hash"))).To(Equal("none"))
+	})
+
+	It("should store lists", func() {
+		Expect(subject.RPush([]byte("list"), now, []byte("c"), []byte("d"))).To(Equal(2))
+		Expect(subject.LPush([]byte("list"), now, []byte("b"), []byte("a"))).To(Equal(4))
+		Expect(subject.LRange([]byte("list"), 0, -1)).To(Equal([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}))
+		Expect(subject.LRange([]byte("list"), -2, 10)).To(Equal([][]byte{[]byte("c"), []byte("d")}))
+		Expect(subject.LRange([]byte("list"), 3, 1)).To(BeEmpty())
+		Expect(subject.LLen([]byte("list"))).To(Equal(4))
+
+		Expect(subject.LPop([]byte("list"), now)).To(Equal([]byte("a")))
+		Expect(subject.RPop([]byte("list"), now)).To(Equal([]byte("d")))
+		Expect(subject.RPop([]byte("list"), now)).To(Equal([]byte("c")))
+		Expect(subject.RPop([]byte("list"), now)).To(Equal([]byte("b")))
+		Expect(subject.RPop([]byte("list"), now)).To(BeNil())
+		Expect(subject.Type([]byte("list"))).To(Equal("none"))
+	})
+
+	It("should store sets", func() {
+		Expect(subject.SAdd([]byte("set"), now, []byte("b"), []byte("a"), []byte("b"))).To(Equal(2))
+		Expect(subject.SAdd([]byte("set"), now, []byte("c"), []byte("a"))).To(Equal(1))
+		Expect(subject.SCard([]byte("set"))).To(Equal(3))
+		Expect(subject.SIsMember([]byte("set"), []byte("a"))).To(BeTrue())
+		Expect(subject.SIsMember([]byte("set"), []byte("x"))).To(BeFalse())
+		Expect(subject.SMembers([]byte("set"))).To(Equal([][]byte{[]byte("a"), []byte("b"), []byte("c")}))
+		Expect(subject.SRem([]byte("set"), now, []byte("a"), []byte("x"))).To(Equal(1))
+		Expect(subject.SCard([]byte("set"))).To(Equal(2))
+	})
+
+	It("should store sorted sets", func() {
+		Expect(subject.ZAdd([]byte("zset"), 3, []byte("c"), now)).To(BeTrue())
+		Expect(subject.ZAdd([]byte("zset"), 1, []byte("b"), now)).To(BeTrue())
+		Expect(subject.ZAdd([]byte("zset"), 1, []byte("a"), now)).To(BeTrue())
+		Expect(subject.ZAdd([]byte("zset"), 0, []byte("c"), now)).To(BeFalse())
+		Expect(subject.ZCard([]byte("zset"))).To(Equal(3))
+		Expect(subject.ZRange([]byte("zset"), 0, -1)).To(Equal([]planb.ScoredMember{
+			{Member: []byte("c"), Score: 0},
+			{Member: []byte("a"), Score: 1},
+			{Member: []byte("b"), Score: 1},
+		}))
+
+		score, ok, err := subject.ZScore([]byte("zset"), []byte("a"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(score).To(Equal(1.0))
+
+		Expect(subject.ZRem([]byte("zset"), now, []byte("a"), []byte("x"))).To(Equal(1))
+		Expect(subject.ZRange([]byte("zset"), -1, -1)).To(Equal([]planb.ScoredMember{
+			{Member: []byte("b"), Score: 1},
+		}))
+	})
+
+	It("should check types", func() {
+		Expect(subject.SAdd([]byte("set"), now, []byte("a"))).To(Equal(1))
+
+		_, err := subject.Get([]byte("set"))
+		Expect(err).To(Equal(planb.ErrWrongType))
+		_, err = subject.HSet([]byte("set"), []byte("f"), []byte("v"), now)
+		Expect(err).To(Equal(planb.ErrWrongType))
+		_, err = subject.LLen([]byte("key1"))
+		Expect(err).To(Equal(planb.ErrWrongType))
+		Expect(err.Error()).To(HavePrefix("WRONGTYPE "))
+
+		Expect(subject.Type([]byte("key1"))).To(Equal("string"))
+		Expect(subject.Put([]byte("set"), []byte("val"))).To(Succeed())
+		Expect(subject.Type([]byte("set"))).To(Equal("string"))
+	})
+
+	It("should treat expired keys as missing on modification", func() {
+		Expect(subject.PutWithTTL([]byte("key5"), []byte("val5"), time.Second, now)).To(Succeed())
+
+		_, err := subject.HSet([]byte("key5"), []byte("f"), []byte("v"), now)
+		Expect(err).To(Equal(planb.ErrWrongType))
+		Expect(subject.SRem([]byte("key5"), now.Add(time.Second), []byte("a"))).To(Equal(0))
+		Expect(subject.HSet([]byte("key5"), []byte("f"), []byte("v"), now.Add(time.Second))).To(BeTrue())
+		Expect(subject.HGet([]byte("key5"), []byte("f"))).To(Equal([]byte("v")))
+		Expect(subject.TTL([]byte("key5"), now.Add(time.Minute))).To(Equal(time.Duration(-1)))
+	})
+
+	It("should snapshot/restore typed values", func() {
+		Expect(subject.HSet([]byte("hash"), []byte("f"), []byte("v"), now)).To(BeTrue())
+		Expect(subject.RPush([]byte("list"), now, []byte("a"), []byte("b"))).To(Equal(2))
+		Expect(subject.SAdd([]byte("set"), now, []byte("a"))).To(Equal(1))
+		Expect(subject.ZAdd([]byte("zset"), 1.5, []byte("a"), now)).To(BeTrue())
+
+		snap, err := subject.Freeze()
+		Expect(err).NotTo(HaveOccurred())
+		defer snap.Release()
+
+		Expect(subject.HSet([]byte("hash"), []byte("f"), []byte("x"), now)).To(BeFalse())
+		Expect(subject.RPush([]byte("list"), now, []byte("c"))).To(Equal(3))
+		Expect(subject.SRem([]byte("set"), now, []byte("a"))).To(Equal(1))
+		Expect(subject.ZAdd([]byte("zset"), 2.5, []byte("a"), now)).To(BeFalse())
+
+		buf := new(bytes.Buffer)
+		Expect(snap.Persist(buf)).To(Succeed())
+
+		restored := planb.NewInmemStore()
+		Expect(restored.Restore(buf)).To(Succeed())
+		Expect(restored.Get([]byte("key1"))).To(Equal([]byte("val1")))
+		Expect(restored.HGet([]byte("hash"), []byte("f"))).To(Equal([]byte("v")))
+		Expect(restored.LRange([]byte("list"), 0, -1)).To(Equal([][]byte{[]byte("a"), []byte("b")}))
+		Expect(restored.SMembers([]byte("set"))).To(Equal([][]byte{[]byte("a")}))
+		Expect(restored.ZRange([]byte("zset"), 0, -1)).To(Equal([]planb.ScoredMember{{Member: []byte("a"), Score: 1.5}}))
+	})
+
+	Describe("ordered", func() {
+		BeforeEach(func() {
+			subject = planb.NewOrderedInmemStore()
+			for _, key := range []string{"b", "d", "a", "e", "c", "ab", "ba"} {
+				Expect(subject.Put([]byte(key), []byte("val"))).To(Succeed())
+			}
+			Expect(subject.Delete([]byte("e"))).To(Succeed())
+		})
+
+		It("should scan in order", func() {
+			Expect(scanAll(subject, nil, 2)).To(Equal([]string{"a", "ab", "b", "ba", "c", "d"}))
+			Expect(scanAll(subject, []byte("b"), 1)).To(Equal([]string{"b", "ba"}))
+		})
+
+		It("should support range queries", func() {
+			keys, err := subject.Range([]byte("ab"), []byte("c"), 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(Equal([][]byte{[]byte("ab"), []byte("b"), []byte("ba")}))
+
+			keys, err = subject.Range([]byte("b"), nil, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(Equal([][]byte{[]byte("b"), []byte("ba")}))
+
+			_, err = planb.NewInmemStore().Range(nil, nil, 10)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should rebuild index on restore", func() {
+			buf := new(bytes.Buffer)
+			Expect(subject.Snapshot(buf)).To(Succeed())
+			Expect(subject.Put([]byte("f"), []byte("val"))).To(Succeed())
+
+			Expect(subject.Restore(buf)).To(Succeed())
+			Expect(scanAll(subject, nil, 10)).To(Equal([]string{"a", "ab", "b", "ba", "c", "d"}))
+		})
+	})
+
 })
+
+func scanAll(s *planb.InmemStore, prefix []byte, count int) []string {
+	var keys []string
+	var cursor []byte
+	for {
+		res, next, err := s.Scan(cursor, prefix, count)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(res)).To(BeNumerically("<=", count))
+		for _, key := range res {
+			keys = append(keys, string(key))
+		}
+		if next == nil {
+			return keys
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,599 @@
+package planb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// ErrWrongType is returned when an operation is
+// performed against a key of a different type.
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// value types
+const (
+	inMemTypeString byte = iota
+	inMemTypeHash
+	inMemTypeList
+	inMemTypeSet
+	inMemTypeZSet
+)
+
+var inMemTypeNames = []string{"string", "hash", "list", "set", "zset"}
+
+// ScoredMember is a member of a sorted set.
+type ScoredMember struct {
+	Member []byte
+	Score  float64
+}
+
+// Type returns the type of the value stored at key: string, hash, list, set,
+// zset or none, if the key does not exist.
+func (s *InmemStore) Type(key []byte) (string, error) {
+	if len(key) == 0 {
+		return "", errInvalidStorageKey
+	}
+
+	typ, ok := s.shard(key).Type(key, time.Now().UnixNano())
+	if !ok {
+		return "none", nil
+	}
+	return inMemTypeNames[typ], nil
+}
+
+// --------------------------------------------------------------------
+// Typed values are read relative to the local clock, just like Get.
+// Mutations are applied relative to now, which should be LogMeta.Time
+// to produce consistent results on all nodes. Expired keys are treated
+// as missing, just like GetAt.
+
+// HGet returns the value of a hash field.
+func (s *InmemStore) HGet(key, field []byte) (val []byte, err error) {
+	err = s.view(key, inMemTypeHash, func(c inMemContainer) {
+		val = c.(*inMemHash).m[string(field)]
+	})
+	return
+}
+
+// HGetAll returns all fields and values of a hash.
+func (s *InmemStore) HGetAll(key []byte) (vals map[string][]byte, err error) {
+	err = s.view(key, inMemTypeHash, func(c inMemContainer) {
+		vals = make(map[string][]byte, c.Len())
+		for field, val := range c.(*inMemHash).m {
+			vals[field] = val
+		}
+	})
+	return
+}
+
+// HLen returns the number of fields in a hash.
+func (s *InmemStore) HLen(key []byte) (n int, err error) {
+	err = s.view(key, inMemTypeHash, func(c inMemContainer) { n = c.Len() })
+	return
+}
+
+// HSet sets a hash field. Returns true if the field is new.
+func (s *InmemStore) HSet(key, field, val []byte, now time.Time) (created bool, err error) {
+	err = s.modify(key, inMemTypeHash, true, now, func(c inMemContainer) {
+		h := c.(*inMemHash)
+		_, exists := h.m[string(field)]
+		h.m[string(field)] = val
+		created = !exists
+	})
+	return
+}
+
+// HDel deletes hash fields. Returns the number of deleted fields.
+func (s *InmemStore) HDel(key []byte, now time.Time, fields ...[]byte) (n int, err error) {
+	err = s.modify(key, inMemTypeHash, false, now, func(c inMemContainer) {
+		h := c.(*inMemHash)
+		for _, field := range fields {
+			if _, ok := h.m[string(field)]; ok {
+				delete(h.m, string(field))
+				n++
+			}
+		}
+	})
+	return
+}
+
+// LLen returns the length of a list.
+func (s *InmemStore) LLen(key []byte) (n int, err error) {
+	err = s.view(key, inMemTypeList, func(c inMemContainer) { n = c.Len() })
+	return
+}
+
+// LRange returns the elements of a list between start and stop (inclusive).
+// Negative offsets are relative to the end of the list.
+func (s *InmemStore) LRange(key []byte, start, stop int) (vals [][]byte, err error) {
+	err = s.view(key, inMemTypeList, func(c inMemContainer) {
+		items := c.(*inMemList).items
+		if start, stop, ok := normRange(start, stop, len(items)); ok {
+			vals = append(vals, items[start:stop+1]...)
+		}
+	})
+	return
+}
+
+// LPush prepends values to a list. Returns the new length of the list.
+func (s *InmemStore) LPush(key []byte, now time.Time, vals ...[]byte) (n int, err error) {
+	err = s.modify(key, inMemTypeList, len(vals) != 0, now, func(c inMemContainer) {
+		l := c.(*inMemList)
+		items := make([][]byte, 0, len(vals)+len(l.items))
+		for i := len(vals) - 1; i >= 0; i-- {
+			items = append(items, vals[i])
+		}
+		l.items = append(items, l.items...)
+		n = len(l.items)
+	})
+	return
+}
+
+// RPush appends values to a list. Returns the new length of the list.
+func (s *InmemStore) RPush(key []byte, now time.Time, vals ...[]byte) (n int, err error) {
+	err = s.modify(key, inMemTypeList, len(vals) != 0, now, func(c inMemContainer) {
+		l := c.(*inMemList)
+		l.items = append(l.items, vals...)
+		n = len(l.items)
+	})
+	return
+}
+
+// LPop removes and returns the first element of a list.
+func (s *InmemStore) LPop(key []byte, now time.Time) (val []byte, err error) {
+	err = s.modify(key, inMemTypeList, false, now, func(c inMemContainer) {
+		l := c.(*inMemList)
+		val, l.items = l.items[0], l.items[1:]
+	})
+	return
+}
+
+// RPop removes and returns the last element of a list.
+func (s *InmemStore) RPop(key []byte, now time.Time) (val []byte, err error) {
+	err = s.modify(key, inMemTypeList, false, now, func(c inMemContainer) {
+		l := c.(*inMemList)
+		n := len(l.items) - 1
+		val, l.items = l.items[n], l.items[:n]
+	})
+	return
+}
+
+// SCard returns the number of members in a set.
+func (s *InmemStore) SCard(key []byte) (n int, err error) {
+	err = s.view(key, inMemTypeSet, func(c inMemContainer) { n = c.Len() })
+	return
+}
+
+// SIsMember returns true if member is part of a set.
+func (s *InmemStore) SIsMember(key, member []byte) (ok bool, err error) {
+	err = s.view(key, inMemTypeSet, func(c inMemContainer) {
+		_, ok = c.(*inMemSet).m[string(member)]
+	})
+	return
+}
+
+// SMembers returns all members of a set, in lexicographical order.
+func (s *InmemStore) SMembers(key []byte) (members [][]byte, err error) {
+	err = s.view(key, inMemTypeSet, func(c inMemContainer) {
+		members = c.(*inMemSet).Members()
+	})
+	return
+}
+
+// SAdd adds members to a set. Returns the number of added members.
+func (s *InmemStore) SAdd(key []byte, now time.Time, members ...[]byte) (n int, err error) {
+	err = s.modify(key, inMemTypeSet, len(members) != 0, now, func(c inMemContainer) {
+		m := c.(*inMemSet).m
+		for _, member := range members {
+			if _, ok := m[string(member)]; !ok {
+				m[string(member)] = struct{}{}
+				n++
+			}
+		}
+	})
+	return
+}
+
+// SRem removes members from a set. Returns the number of removed members.
+func (s *InmemStore) SRem(key []byte, now time.Time, members ...[]byte) (n int, err error) {
+	err = s.modify(key, inMemTypeSet, false, now, func(c inMemContainer) {
+		m := c.(*inMemSet).m
+		for _, member := range members {
+			if _, ok := m[string(member)]; ok {
+				delete(m, string(member))
+				n++
+			}
+		}
+	})
+	return
+}
+
+// ZCard returns the number of members in a sorted set.
+func (s *InmemStore) ZCard(key []byte) (n int, err error) {
+	err = s.view(key, inMemTypeZSet, func(c inMemContainer) { n = c.Len() })
+	return
+}
+
+// ZScore returns the score of a sorted set member.
+func (s *InmemStore) ZScore(key, member []byte) (score float64, ok bool, err error) {
+	err = s.view(key, inMemTypeZSet, func(c inMemContainer) {
+		score, ok = c.(*inMemZSet).scores[string(member)]
+	})
+	return
+}
+
+// ZRange returns the members of a sorted set between start and stop
+// (inclusive), ordered by score. Negative offsets are relative to the end.
+func (s *InmemStore) ZRange(key []byte, start, stop int) (members []ScoredMember, err error) {
+	err = s.view(key, inMemTypeZSet, func(c inMemContainer) {
+		sorted := c.(*inMemZSet).sorted
+		if start, stop, ok := normRange(start, stop, len(sorted)); ok {
+			members = append(members, sorted[start:stop+1]...)
+		}
+	})
+	return
+}
+
+// ZAdd adds a member to a sorted set or updates its score.
+// Returns true if the member is new.
+func (s *InmemStore) ZAdd(key []byte, score float64, member []byte, now time.Time) (created bool, err error) {
+	if math.IsNaN(score) {
+		return false, errInvalidScore
+	}
+
+	err = s.modify(key, inMemTypeZSet, true, now, func(c inMemContainer) {
+		created = c.(*inMemZSet).Add(score, member)
+	})
+	return
+}
+
+// ZRem removes members from a sorted set. Returns the number of removed members.
+func (s *InmemStore) ZRem(key []byte, now time.Time, members ...[]byte) (n int, err error) {
+	err = s.modify(key, inMemTypeZSet, false, now, func(c inMemContainer) {
+		z := c.(*inMemZSet)
+		for _, member := range members {
+			if z.Remove(member) {
+				n++
+			}
+		}
+	})
+	return
+}
+
+func (s *InmemStore) view(key []byte, typ byte, fn func(inMemContainer)) error {
+	if len(key) == 0 {
+		return errInvalidStorageKey
+	}
+	return s.shard(key).View(key, typ, time.Now().UnixNano(), fn)
+}
+
+func (s *InmemStore) modify(key []byte, typ byte, create bool, now time.Time, fn func(inMemContainer)) error {
+	if len(key) == 0 {
+		return errInvalidStorageKey
+	}
+	return s.shard(key).Modify(key, typ, create, now.UnixNano(), fn)
+}
+
+// normRange normalises a range of inclusive
+// offsets, negative offsets count from the end.
+func normRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, start <= stop
+}
+
+// --------------------------------------------------------------------
+
+// inMemContainer is a typed value. Containers are copied on write
+// when they were created before the most recent shard freeze.
+type inMemContainer interface {
+	Type() byte
+	Len() int
+	Epoch() uint64
+	Clone(epoch uint64) inMemContainer
+	Encode(buf []byte, w io.Writer) error
+	Decode(r *bufio.Reader) error
+}
+
+func newInMemContainer(typ byte, epoch uint64) inMemContainer {
+	switch typ {
+	case inMemTypeHash:
+		return &inMemHash{epoch: epoch, m: make(map[string][]byte)}
+	case inMemTypeList:
+		return &inMemList{epoch: epoch}
+	case inMemTypeSet:
+		return &inMemSet{epoch: epoch, m: make(map[string]struct{})}
+	case inMemTypeZSet:
+		return &inMemZSet{epoch: epoch, scores: make(map[string]float64)}
+	}
+	return nil
+}
+
+type inMemHash struct {
+	epoch uint64
+	m     map[string][]byte
+}
+
+func (h *inMemHash) Type() byte    { return inMemTypeHash }
+func (h *inMemHash) Len() int      { return len(h.m) }
+func (h *inMemHash) Epoch() uint64 { return h.epoch }
+
+func (h *inMemHash) Clone(epoch uint64) inMemContainer {
+	m := make(map[string][]byte, len(h.m))
+	for field, val := range h.m {
+		m[field] = val
+	}
+	return &inMemHash{epoch: epoch, m: m}
+}
+
+func (h *inMemHash) Encode(buf []byte, w io.Writer) error {
+	if err := writeSnapshotCount(buf, w, len(h.m)); err != nil {
+		return err
+	}
+	for field, val := range h.m {
+		if err := writeSnapshotField(buf, w, []byte(field)); err != nil {
+			return err
+		}
+		if err := writeSnapshotField(buf, w, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *inMemHash) Decode(r *bufio.Reader) error {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		field, err := readSnapshotField(r)
+		if err != nil {
+			return err
+		}
+		val, err := readSnapshotField(r)
+		if err != nil {
+			return err
+		}
+		h.m[string(field)] = val
+	}
+	return nil
+}
+
+type inMemList struct {
+	epoch uint64
+	items [][]byte
+}
+
+func (l *inMemList) Type() byte    { return inMemTypeList }
+func (l *inMemList) Len() int      { return len(l.items) }
+func (l *inMemList) Epoch() uint64 { return l.epoch }
+
+func (l *inMemList) Clone(epoch uint64) inMemContainer {
+	return &inMemList{epoch: epoch, items: append([][]byte(nil), l.items...)}
+}
+
+func (l *inMemList) Encode(buf []byte, w io.Writer) error {
+	if err := writeSnapshotCount(buf, w, len(l.items)); err != nil {
+		return err
+	}
+	for _, item := range l.items {
+		if err := writeSnapshotField(buf, w, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *inMemList) Decode(r *bufio.Reader) error {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		item, err := readSnapshotField(r)
+		if err != nil {
+			return err
+		}
+		l.items = append(l.items, item)
+	}
+	return nil
+}
+
+type inMemSet struct {
+	epoch uint64
+	m     map[string]struct{}
+}
+
+func (s *inMemSet) Type() byte    { return inMemTypeSet }
+func (s *inMemSet) Len() int      { return len(s.m) }
+func (s *inMemSet) Epoch() uint64 { return s.epoch }
+
+func (s *inMemSet) Clone(epoch uint64) inMemContainer {
+	m := make(map[string]struct{}, len(s.m))
+	for member := range s.m {
+		m[member] = struct{}{}
+	}
+	return &inMemSet{epoch: epoch, m: m}
+}
+
+// Members returns all members in lexicographical order.
+func (s *inMemSet) Members() [][]byte {
+	strs := make([]string, 0, len(s.m))
+	for member := range s.m {
+		strs = append(strs, member)
+	}
+	sort.Strings(strs)
+
+	members := make([][]byte, len(strs))
+	for i, member := range strs {
+		members[i] = []byte(member)
+	}
+	return members
+}
+
+func (s *inMemSet) Encode(buf []byte, w io.Writer) error {
+	if err := writeSnapshotCount(buf, w, len(s.m)); err != nil {
+		return err
+	}
+	for member := range s.m {
+		if err := writeSnapshotField(buf, w, []byte(member)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *inMemSet) Decode(r *bufio.Reader) error {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		member, err := readSnapshotField(r)
+		if err != nil {
+			return err
+		}
+		s.m[string(member)] = struct{}{}
+	}
+	return nil
+}
+
+type inMemZSet struct {
+	epoch  uint64
+	scores map[string]float64
+	sorted []ScoredMember // ordered by score, then member
+}
+
+func (z *inMemZSet) Type() byte    { return inMemTypeZSet }
+func (z *inMemZSet) Len() int      { return len(z.scores) }
+func (z *inMemZSet) Epoch() uint64 { return z.epoch }
+
+func (z *inMemZSet) Clone(epoch uint64) inMemContainer {
+	scores := make(map[string]float64, len(z.scores))
+	for member, score := range z.scores {
+		scores[member] = score
+	}
+	return &inMemZSet{epoch: epoch, scores: scores, sorted: append([]ScoredMember(nil), z.sorted...)}
+}
+
+// Add adds a member or updates its score. Returns true if the member is new.
+func (z *inMemZSet) Add(score float64, member []byte) bool {
+	if prev, ok := z.scores[string(member)]; ok {
+		if prev == score {
+			return false
+		}
+		z.remove(prev, member)
+	}
+
+	pos := z.search(score, member)
+	z.sorted = append(z.sorted, ScoredMember{})
+	copy(z.sorted[pos+1:], z.sorted[pos:])
+	z.sorted[pos] = ScoredMember{Member: []byte(string(member)), Score: score}
+
+	_, exists := z.scores[string(member)]
+	z.scores[string(member)] = score
+	return !exists
+}
+
+// Remove removes a member. Returns true if the member existed.
+func (z *inMemZSet) Remove(member []byte) bool {
+	score, ok := z.scores[string(member)]
+	if !ok {
+		return false
+	}
+	z.remove(score, member)
+	delete(z.scores, string(member))
+	return true
+}
+
+func (z *inMemZSet) remove(score float64, member []byte) {
+	pos := z.search(score, member)
+	z.sorted = append(z.sorted[:pos], z.sorted[pos+1:]...)
+}
+
+// search returns the position of the first entry >= (score, member).
+func (z *inMemZSet) search(score float64, member []byte) int {
+	return sort.Search(len(z.sorted), func(i int) bool {
+		e := z.sorted[i]
+		return e.Score > score || (e.Score == score && string(e.Member) >= string(member))
+	})
+}
+
+func (z *inMemZSet) Encode(buf []byte, w io.Writer) error {
+	if err := writeSnapshotCount(buf, w, len(z.sorted)); err != nil {
+		return err
+	}
+	for _, e := range z.sorted {
+		if err := writeSnapshotField(buf, w, e.Member); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(buf[:8], math.Float64bits(e.Score))
+		if _, err := w.Write(buf[:8]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *inMemZSet) Decode(r *bufio.Reader) error {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8)
+	for i := uint64(0); i < n; i++ {
+		member, err := readSnapshotField(r)
+		if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		z.Add(math.Float64frombits(binary.BigEndian.Uint64(buf)), member)
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+func writeSnapshotCount(buf []byte, w io.Writer, n int) error {
+	m := binary.PutUvarint(buf[:binary.MaxVarintLen64], uint64(n))
+	_, err := w.Write(buf[:m])
+	return err
+}
+
+func writeSnapshotField(buf []byte, w io.Writer, p []byte) error {
+	if err := writeSnapshotCount(buf, w, len(p)); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+func readSnapshotField(r *bufio.Reader) ([]byte, error) {
+	u, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, int(u))
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -1,11 +1,16 @@
 package planb_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bsm/planb"
 	"github.com/bsm/redeo"
@@ -19,6 +24,7 @@ import (
 var _ = Describe("Server (integration)", func() {
 	var nodes testNodes
 	var leader, follower *testNode
+	var configure func(*planb.Config)
 
 	var skipOnShort = func(cb func()) func() {
 		return func() {
@@ -28,12 +34,17 @@ var _ = Describe("Server (integration)", func() {
 		}
 	}
 
-	BeforeEach(skipOnShort(func() {
-		var err error
+	BeforeEach(func() {
+		configure = nil
+	})
 
+	JustBeforeEach(skipOnShort(func() {
 		nodes = make(testNodes, 3)
 		for i := 0; i < 3; i++ {
-			nodes[i], err = newTestNode()
+			lis, err := net.Listen("tcp", "127.0.0.1:")
+			Expect(err).NotTo(HaveOccurred())
+
+			nodes[i], err = newConfiguredTestNode(lis, configure)
 			Expect(err).NotTo(HaveOccurred())
 		}
 		for _, n := range nodes {
@@ -44,6 +55,7 @@ var _ = Describe("Server (integration)", func() {
 			return nodes[0].Cmd("raft", "leader")
 		}, "10s").ShouldNot(BeEmpty())
 
+		var err error
 		leader, err = nodes.Find("leader")
 		Expect(err).NotTo(HaveOccurred())
 
@@ -72,6 +84,574 @@ var _ = Describe("Server (integration)", func() {
 		Eventually(func() (string, error) { return follower.Cmd("GET", "key") }).Should(Equal("v2"))
 	}))
 
+	It("should forward writes from followers to leader", skipOnShort(func() {
+		Expect(follower.Cmd("FSET", "key", "v1")).To(Equal("OK"))
+		Expect(leader.Cmd("GET", "key")).To(Equal("v1"))
+		Eventually(func() (string, error) { return follower.Cmd("GET", "key") }).Should(Equal("v1"))
+
+		Expect(follower.Cmd("FSET", "key")).To(Equal("ERR wrong number of arguments for 'FSET' command"))
+	}))
+
+	Context("with batching", func() {
+		BeforeEach(func() {
+			configure = func(conf *planb.Config) { conf.Batch.MaxSize = 8 }
+		})
+
+		It("should batch concurrent writes", skipOnShort(func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					key := fmt.Sprintf("key%d", i)
+					Expect(leader.Cmd("SET", key, "v1")).To(Equal("OK"))
+					Expect(leader.Cmd("GET", key)).To(Equal("v1"))
+				}(i)
+			}
+			wg.Wait()
+
+			Expect(leader.Cmd("SET", "key", "v1", "bad")).To(Equal("ERR wrong number of arguments for 'SET' command"))
+			Eventually(func() (string, error) { return follower.Cmd("GET", "key19") }).Should(Equal("v1"))
+		}))
+
+		It("should batch pipelined writes of a single connection", skipOnShort(func() {
+			cn, err := leader.cln.Get()
+			Expect(err).NotTo(HaveOccurred())
+			defer leader.cln.Put(cn)
+
+			index := leader.srv.Raft().LastIndex()
+			for i := 0; i < 16; i++ {
+				cn.WriteCmdString("SET", fmt.Sprintf("key%d", i), fmt.Sprintf("v%d", i))
+			}
+			cn.WriteCmdString("GET", "key15")
+			cn.WriteCmdString("SET", "key", "v1", "bad")
+			cn.WriteCmdString("SET", "key16", "v16")
+			Expect(cn.Flush()).To(Succeed())
+
+			for i := 0; i < 16; i++ {
+				Expect(cn.ReadBulkString()).To(Equal("OK"))
+			}
+			Expect(cn.ReadBulkString()).To(Equal("v15"))
+			Expect(cn.ReadError()).To(Equal("ERR wrong number of arguments for 'SET' command"))
+			Expect(cn.ReadBulkString()).To(Equal("OK"))
+
+			// 17 writes, proposed in batches of up to 8 commands
+			Expect(leader.srv.Raft().LastIndex() - index).To(BeNumerically("<=", 4))
+			Eventually(func() (string, error) { return follower.Cmd("GET", "key16") }).Should(Equal("v16"))
+		}))
+	})
+
+	It("should replicate MULTI/EXEC transactions", skipOnShort(func() {
+		cn, err := leader.cln.Get()
+		Expect(err).NotTo(HaveOccurred())
+		defer leader.cln.Put(cn)
+
+		cn.WriteCmdString("EXEC")
+		cn.WriteCmdString("MULTI")
+		cn.WriteCmdString("SET", "key1", "v1")
+		cn.WriteCmdString("SET", "key2", "v2")
+		cn.WriteCmdString("GET", "key1")
+		cn.WriteCmdString("SET", "key3")
+		cn.WriteCmdString("EXEC")
+		Expect(cn.Flush()).To(Succeed())
+
+		Expect(cn.ReadError()).To(Equal("ERR EXEC without MULTI"))
+		Expect(cn.ReadInlineString()).To(Equal("OK"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadArrayLen()).To(Equal(4))
+		Expect(cn.ReadBulkString()).To(Equal("OK"))
+		Expect(cn.ReadBulkString()).To(Equal("OK"))
+		Expect(cn.ReadBulkString()).To(Equal("v1"))
+		Expect(cn.ReadError()).To(Equal("ERR wrong number of arguments for 'SET' command"))
+
+		Eventually(func() (string, error) { return follower.Cmd("GET", "key2") }).Should(Equal("v2"))
+
+		cn.WriteCmdString("MULTI")
+		cn.WriteCmdString("SET", "key1", "v3")
+		cn.WriteCmdString("DISCARD")
+		cn.WriteCmdString("GET", "key1")
+		Expect(cn.Flush()).To(Succeed())
+
+		Expect(cn.ReadInlineString()).To(Equal("OK"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadInlineString()).To(Equal("OK"))
+		Expect(cn.ReadBulkString()).To(Equal("v1"))
+	}))
+
+	It("should queue local commands in MULTI/EXEC transactions", skipOnShort(func() {
+		cn, err := leader.cln.Get()
+		Expect(err).NotTo(HaveOccurred())
+		defer leader.cln.Put(cn)
+
+		cn.WriteCmdString("MULTI")
+		cn.WriteCmdString("PING")
+		cn.WriteCmdString("SET", "key1", "v1")
+		cn.WriteCmdString("RAFT", "LEADER")
+		cn.WriteCmdString("EXEC")
+		cn.WriteCmdString("MULTI")
+		cn.WriteCmdString("PING")
+		cn.WriteCmdString("EXEC")
+		Expect(cn.Flush()).To(Succeed())
+
+		Expect(cn.ReadInlineString()).To(Equal("OK"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadArrayLen()).To(Equal(3))
+		Expect(cn.ReadBulkString()).To(Equal("PONG"))
+		Expect(cn.ReadBulkString()).To(Equal("OK"))
+		Expect(cn.ReadBulkString()).To(Equal(leader.Addr()))
+
+		Expect(cn.ReadInlineString()).To(Equal("OK"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadArrayLen()).To(Equal(1))
+		Expect(cn.ReadBulkString()).To(Equal("PONG"))
+	}))
+
+	It("should forward MULTI/EXEC transactions from followers to leader", skipOnShort(func() {
+		cn, err := follower.cln.Get()
+		Expect(err).NotTo(HaveOccurred())
+		defer follower.cln.Put(cn)
+
+		cn.WriteCmdString("MULTI")
+		cn.WriteCmdString("FSET", "key1", "v1")
+		cn.WriteCmdString("GET", "key1")
+		cn.WriteCmdString("EXEC")
+		cn.WriteCmdString("MULTI")
+		cn.WriteCmdString("SET", "key2", "v2")
+		cn.WriteCmdString("FSET", "key3", "v3")
+		cn.WriteCmdString("EXEC")
+		Expect(cn.Flush()).To(Succeed())
+
+		Expect(cn.ReadInlineString()).To(Equal("OK"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadArrayLen()).To(Equal(2))
+		Expect(cn.ReadBulkString()).To(Equal("OK"))
+		Expect(cn.ReadBulkString()).To(Equal("v1"))
+
+		Expect(cn.ReadInlineString()).To(Equal("OK"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadInlineString()).To(Equal("QUEUED"))
+		Expect(cn.ReadError()).To(Equal("READONLY node is not the leader"))
+
+		Expect(leader.Cmd("GET", "key1")).To(Equal("v1"))
+		Expect(leader.Cmd("GET", "key3")).To(Equal(""))
+	}))
+
+	It("should expose log metadata to context handlers", skipOnShort(func() {
+		Expect(leader.Cmd("SET", "key", "v1")).To(Equal("OK"))
+		Expect(leader.Cmd("META")).To(MatchRegexp(`^index:\d+ term:\d+ replay:false$`))
+	}))
+
+	It("should apply deterministic time and randomness", skipOnShort(func() {
+		Expect(leader.Cmd("RSET", "key")).To(Equal("OK"))
+
+		val, err := leader.Cmd("GET", "key")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(val).To(MatchRegexp(`^\d+:\d+$`))
+		Eventually(func() (string, error) { return follower.Cmd("GET", "key") }).Should(Equal(val))
+	}))
+
+	Context("with expiry sweeps", func() {
+		BeforeEach(func() {
+			configure = func(conf *planb.Config) { conf.Expiry.SweepInterval = 50 * time.Millisecond }
+		})
+
+		It("should expire keys on all nodes", skipOnShort(func() {
+			Expect(leader.Cmd("SETEX", "key", "500", "v1")).To(Equal("OK"))
+			Expect(leader.Cmd("GET", "key")).To(Equal("v1"))
+			Eventually(func() (string, error) { return follower.Cmd("GET", "key") }).Should(Equal("v1"))
+
+			Eventually(func() (time.Duration, error) { return follower.kvs.TTL([]byte("key"), time.Time{}) }, "2s").Should(Equal(time.Duration(-2)))
+			Expect(leader.kvs.TTL([]byte("key"), time.Time{})).To(Equal(time.Duration(-2)))
+		}))
+	})
+
+	It("should serve linearizable reads on leader only", skipOnShort(func() {
+		Expect(leader.Cmd("SET", "key", "v1")).To(Equal("OK"))
+		Expect(leader.Cmd("LGET", "key")).To(Equal("v1"))
+		Expect(follower.Cmd("LGET", "key")).To(Equal("NOTLEADER node is not the leader"))
+	}))
+
+	It("should serve bounded-staleness reads on followers", skipOnShort(func() {
+		Expect(leader.Cmd("SET", "key", "v1")).To(Equal("OK"))
+		Expect(leader.Cmd("BGET", "key")).To(Equal("v1"))
+		Eventually(func() (string, error) { return follower.Cmd("BGET", "key") }).Should(Equal("v1"))
+	}))
+
+	It("should export and restore snapshots", skipOnShort(func() {
+		Expect(leader.Cmd("SET", "key", "v1")).To(Equal("OK"))
+		Expect(leader.Cmd("RAFT", "SNAPSHOT")).To(Equal("OK"))
+		Expect(leader.Cmd("BGSAVE")).To(Equal("Background saving started"))
+		Eventually(func() (string, error) { return leader.Cmd("INFO") }).Should(ContainSubstring("bgsave_last_status:ok\n"))
+
+		data, err := ioutil.ReadFile(filepath.Join(leader.dir, "dump.planb"))
+		Expect(err).NotTo(HaveOccurred())
+
+		// seed a fresh cluster
+		node, err := newTestNode()
+		Expect(err).NotTo(HaveOccurred())
+		defer node.Close()
+
+		Expect(node.Cmd("raft", "bootstrap", node.Addr())).To(Equal("OK"))
+		Eventually(func() (string, error) { return node.Cmd("raft", "state") }, "5s").Should(Equal("leader"))
+		Expect(node.Cmd("SET", "key", "v2")).To(Equal("OK"))
+		Expect(node.Cmd("SET", "other", "v2")).To(Equal("OK"))
+
+		Expect(node.Cmd("RAFT", "RESTORE")).To(Equal("ERR unable to restore: open " + filepath.Join(node.dir, "dump.planb") + ": no such file or directory"))
+		Expect(node.Cmd("RAFT", "RESTORE", "../dump.planb")).To(Equal("ERR unable to restore: planb: invalid file name"))
+
+		Expect(ioutil.WriteFile(filepath.Join(node.dir, "dump.planb"), data[:len(data)-1], 0666)).To(Succeed())
+		Expect(node.Cmd("RAFT", "RESTORE")).To(Equal("ERR unable to restore: planb: snapshot checksum mismatch"))
+
+		Expect(ioutil.WriteFile(filepath.Join(node.dir, "dump.planb"), data, 0666)).To(Succeed())
+		Expect(node.Cmd("RAFT", "RESTORE")).To(Equal("OK"))
+		Expect(node.Cmd("GET", "key")).To(Equal("v1"))
+		Expect(node.Cmd("GET", "other")).To(BeEmpty())
+		Expect(node.Cmd("SET", "other", "v3")).To(Equal("OK"))
+		Expect(node.Cmd("GET", "other")).To(Equal("v3"))
+	}))
+
+	It("should form clusters from seeds", skipOnShort(func() {
+		var seeds []string
+		var listeners []net.Listener
+		for i := 0; i < 4; i++ {
+			lis, err := net.Listen("tcp", "127.0.0.1:")
+			Expect(err).NotTo(HaveOccurred())
+			listeners = append(listeners, lis)
+			seeds = append(seeds, lis.Addr().String())
+		}
+
+		var configure = func(conf *planb.Config) { conf.Cluster.Seeds = seeds[:3] }
+
+		// start the initial members
+		var seeded testNodes
+		for _, lis := range listeners[:3] {
+			node, err := newConfiguredTestNode(lis, configure)
+			Expect(err).NotTo(HaveOccurred())
+			defer node.Close()
+			seeded = append(seeded, node)
+		}
+		for _, node := range seeded {
+			Eventually(node.Peers, "5s").Should(ConsistOf(seeds[:3]))
+		}
+		Eventually(func() (string, error) { return seeded[0].Cmd("raft", "leader") }, "5s").ShouldNot(BeEmpty())
+		Expect(seeded[0].Cmd("INFO")).To(ContainSubstring("cluster_size:3\n"))
+
+		// add a new node later
+		node, err := newConfiguredTestNode(listeners[3], configure)
+		Expect(err).NotTo(HaveOccurred())
+		defer node.Close()
+
+		Eventually(node.Peers, "5s").Should(ConsistOf(seeds))
+		Eventually(seeded[0].Peers, "5s").Should(ConsistOf(seeds))
+	}))
+
+	It("should only bootstrap from the lowest seed", skipOnShort(func() {
+		var listeners []net.Listener
+		for i := 0; i < 3; i++ {
+			lis, err := net.Listen("tcp", "127.0.0.1:")
+			Expect(err).NotTo(HaveOccurred())
+			listeners = append(listeners, lis)
+		}
+		sort.Slice(listeners, func(i, j int) bool { return listeners[i].Addr().String() < listeners[j].Addr().String() })
+
+		var seeds []string
+		for _, lis := range listeners {
+			seeds = append(seeds, lis.Addr().String())
+		}
+
+		var configure = func(conf *planb.Config) {
+			conf.Cluster.Seeds = seeds
+			conf.Cluster.Expect = 2
+			conf.Cluster.RetryInterval = 100 * time.Millisecond
+		}
+
+		// start all seeds but the lowest
+		var nodes testNodes
+		for _, lis := range listeners[1:] {
+			node, err := newConfiguredTestNode(lis, configure)
+			Expect(err).NotTo(HaveOccurred())
+			defer node.Close()
+			nodes = append(nodes, node)
+		}
+		Consistently(nodes[0].Peers, "500ms").Should(BeEmpty())
+
+		node, err := newConfiguredTestNode(listeners[0], configure)
+		Expect(err).NotTo(HaveOccurred())
+		defer node.Close()
+		nodes = append(nodes, node)
+
+		for _, node := range nodes {
+			Eventually(node.Peers, "5s").Should(ConsistOf(seeds))
+		}
+	}))
+
+	It("should join and leave clusters", skipOnShort(func() {
+		node, err := newTestNode()
+		Expect(err).NotTo(HaveOccurred())
+		defer node.Close()
+
+		Expect(node.Cmd("raft", "leave")).To(Equal("ERR unable to leave cluster: node is not a member"))
+		Expect(node.Cmd("raft", "join", follower.Addr())).To(Equal("OK"))
+		Eventually(leader.Peers).Should(ContainElement(node.Addr()))
+		Eventually(node.Peers).Should(HaveLen(4))
+
+		Expect(node.Cmd("raft", "leave")).To(Equal("OK"))
+		Expect(leader.Peers()).NotTo(ContainElement(node.Addr()))
+
+		Expect(leader.Cmd("raft", "leave")).To(Equal("OK"))
+		Eventually(func() (string, error) { return follower.Cmd("raft", "leader") }, "5s").Should(SatisfyAll(
+			Not(BeEmpty()),
+			Not(Equal(leader.Addr())),
+		))
+		Expect(follower.Peers()).To(HaveLen(2))
+		Expect(follower.Peers()).NotTo(ContainElement(leader.Addr()))
+	}))
+
+	It("should support non-voters", skipOnShort(func() {
+		var suffrage = func(addr string) func() (raft.ServerSuffrage, error) {
+			return func() (raft.ServerSuffrage, error) {
+				member, err := leader.Member(addr)
+				if err != nil {
+					return 0, err
+				}
+				return member.Suffrage, nil
+			}
+		}
+
+		lis, err := net.Listen("tcp", "127.0.0.1:")
+		Expect(err).NotTo(HaveOccurred())
+
+		replica, err := newConfiguredTestNode(lis, func(conf *planb.Config) { conf.Cluster.NonVoter = true })
+		Expect(err).NotTo(HaveOccurred())
+		defer replica.Close()
+
+		Expect(replica.Cmd("INFO")).To(ContainSubstring("suffrage:nonvoter\n"))
+		Expect(replica.Cmd("raft", "join", follower.Addr())).To(Equal("OK"))
+		Eventually(suffrage(replica.Addr())).Should(Equal(raft.Nonvoter))
+		Eventually(func() (string, error) { return replica.Cmd("INFO") }).Should(ContainSubstring("cluster_size:4\n"))
+
+		Expect(leader.Cmd("SET", "key", "v1")).To(Equal("OK"))
+		Eventually(func() (string, error) { return replica.Cmd("GET", "key") }).Should(Equal("v1"))
+		Expect(replica.Cmd("SET", "key", "v2")).To(Equal("READONLY node is not the leader"))
+
+		member, err := leader.Member(replica.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(follower.Cmd("raft", "promote", string(member.ID))).To(Equal("OK"))
+		Eventually(suffrage(replica.Addr())).Should(Equal(raft.Voter))
+		Eventually(func() (string, error) { return replica.Cmd("INFO") }).Should(ContainSubstring("suffrage:voter\n"))
+
+		Expect(leader.Cmd("raft", "demote", string(member.ID))).To(Equal("OK"))
+		Eventually(suffrage(replica.Addr())).Should(Equal(raft.Nonvoter))
+		Expect(leader.Cmd("raft", "promote", "unknown")).To(Equal("ERR unknown server unknown"))
+	}))
+
+	It("should transfer leadership", skipOnShort(func() {
+		Expect(follower.Cmd("raft", "transfer-leader", "unknown")).To(Equal("ERR unknown server unknown"))
+
+		// transfer to any node
+		addr, err := follower.Cmd("raft", "transfer-leader")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addr).NotTo(Equal(leader.Addr()))
+		Expect(nodes.Find("leader")).To(WithTransform(func(n *testNode) string { return n.Addr() }, Equal(addr)))
+		Expect(leader.Member(leader.Addr())).To(WithTransform(func(m *raft.Server) raft.ServerSuffrage { return m.Suffrage }, Equal(raft.Voter)))
+
+		// transfer to a specific node, with two voters
+		leader, err = nodes.Find("leader")
+		Expect(err).NotTo(HaveOccurred())
+		target, err := nodes.Find("follower")
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, n := range nodes {
+			if n != leader && n != target {
+				member, err := leader.Member(n.Addr())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(leader.Cmd("raft", "demote", string(member.ID))).To(Equal("OK"))
+				Expect(n.Cmd("raft", "transfer-leader", n.Addr())).To(Equal("ERR unable to transfer leadership: node is not a voter"))
+			}
+		}
+
+		Expect(leader.Cmd("raft", "transfer-leader", target.Addr())).To(Equal(target.Addr()))
+		Expect(target.Cmd("raft", "state")).To(Equal("leader"))
+		Expect(target.Cmd("raft", "transfer-leader", target.Addr())).To(Equal(target.Addr()))
+		Expect(target.Cmd("raft", "step-down")).To(Equal(leader.Addr()))
+		Expect(target.Cmd("raft", "step-down")).To(Equal("ERR unable to step down: node is not the leader"))
+	}))
+
+	It("should prefer leaders with higher priority", skipOnShort(func() {
+		var seeds []string
+		var listeners []net.Listener
+		for i := 0; i < 3; i++ {
+			lis, err := net.Listen("tcp", "127.0.0.1:")
+			Expect(err).NotTo(HaveOccurred())
+			listeners = append(listeners, lis)
+			seeds = append(seeds, lis.Addr().String())
+		}
+
+		var seeded testNodes
+		for i, lis := range listeners {
+			priority := i * 10
+			node, err := newConfiguredTestNode(lis, func(conf *planb.Config) {
+				conf.Raft.HeartbeatTimeout = 200 * time.Millisecond
+				conf.Raft.ElectionTimeout = 200 * time.Millisecond
+				conf.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+				conf.Cluster.Seeds = seeds
+				conf.Cluster.LeaderPriority = priority
+				conf.Cluster.PriorityCheckInterval = 100 * time.Millisecond
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer node.Close()
+			seeded = append(seeded, node)
+		}
+
+		Expect(seeded[2].Cmd("INFO")).To(ContainSubstring("leader_priority:20\n"))
+		Eventually(func() (string, error) { return seeded[0].Cmd("raft", "leader") }, "20s").Should(Equal(seeded[2].Addr()))
+		Consistently(func() (string, error) { return seeded[2].Cmd("raft", "state") }).Should(Equal("leader"))
+	}))
+
+	It("should track health and replace dead servers", skipOnShort(func() {
+		var seeds []string
+		var listeners []net.Listener
+		for i := 0; i < 3; i++ {
+			lis, err := net.Listen("tcp", "127.0.0.1:")
+			Expect(err).NotTo(HaveOccurred())
+			listeners = append(listeners, lis)
+			seeds = append(seeds, lis.Addr().String())
+		}
+
+		var configure = func(conf *planb.Config) {
+			conf.Cluster.Seeds = seeds
+			conf.Autopilot.Interval = 100 * time.Millisecond
+			conf.Autopilot.LastContactThreshold = 300 * time.Millisecond
+			conf.Autopilot.CleanupDeadServers = true
+		}
+
+		var seeded testNodes
+		for _, lis := range listeners {
+			node, err := newConfiguredTestNode(lis, configure)
+			Expect(err).NotTo(HaveOccurred())
+			defer node.Close()
+			seeded = append(seeded, node)
+		}
+		for _, node := range seeded {
+			Eventually(node.Peers, "5s").Should(ConsistOf(seeds))
+		}
+		Eventually(func() (string, error) { return seeded[0].Cmd("raft", "leader") }, "5s").ShouldNot(BeEmpty())
+
+		leader, err := seeded.Find("leader")
+		Expect(err).NotTo(HaveOccurred())
+		follower, err := seeded.Find("follower")
+		Expect(err).NotTo(HaveOccurred())
+
+		var health = func() (string, error) { return leader.Cmd("raft", "health") }
+		Eventually(health, "5s").Should(ContainSubstring("healthy:1\nfailure_tolerance:1\n"))
+		Expect(health()).To(ContainSubstring("address=" + follower.Addr() + ",suffrage=voter,healthy=1,"))
+		Expect(follower.Cmd("raft", "health")).To(HavePrefix("healthy:1\n"))
+		Expect(leader.Cmd("INFO")).To(ContainSubstring("# Autopilot\nhealthy:1\nfailure_tolerance:1\nservers:3\nhealthy_servers:3\n"))
+
+		// dead servers are retained, to maintain the minimum quorum
+		addr := follower.Addr()
+		var memberID = func() (raft.ServerID, error) {
+			member, err := leader.Member(addr)
+			if err != nil {
+				return "", err
+			}
+			return member.ID, nil
+		}
+		dead, err := memberID()
+		Expect(err).NotTo(HaveOccurred())
+		follower.Close()
+		Eventually(health, "5s").Should(ContainSubstring("healthy:0\nfailure_tolerance:0\n"))
+		Consistently(leader.Peers, "1s").Should(HaveLen(3))
+
+		// until a replacement takes over the address
+		lis, err := net.Listen("tcp", addr)
+		Expect(err).NotTo(HaveOccurred())
+		node, err := newConfiguredTestNode(lis, configure)
+		Expect(err).NotTo(HaveOccurred())
+		defer node.Close()
+
+		Eventually(memberID, "5s").Should(SatisfyAll(Not(BeEmpty()), Not(Equal(dead))))
+		Expect(leader.Peers()).To(ConsistOf(seeds))
+		Expect(health()).NotTo(ContainSubstring(string(dead)))
+		Expect(leader.Cmd("INFO")).To(ContainSubstring("removed_servers:1\n"))
+		Eventually(health, "5s").Should(ContainSubstring("healthy:1\n"))
+	}))
+
+	Context("with backups", func() {
+		var targets []string
+
+		BeforeEach(func() {
+			targets = targets[:0]
+			configure = func(conf *planb.Config) {
+				dir, err := ioutil.TempDir("", "planb-test-backups")
+				Expect(err).NotTo(HaveOccurred())
+				targets = append(targets, dir)
+
+				conf.Backup.Target = planb.DirBackupTarget(dir)
+				conf.Backup.Interval = 100 * time.Millisecond
+				conf.Backup.Retain = 2
+			}
+		})
+
+		AfterEach(func() {
+			for _, n := range nodes {
+				n.Close()
+			}
+			for _, dir := range targets {
+				Expect(os.RemoveAll(dir)).To(Succeed())
+			}
+		})
+
+		It("should ship backups from the leader", skipOnShort(func() {
+			var backups = func(n *testNode) func() ([]string, error) {
+				var dir string
+				for i := range nodes {
+					if nodes[i] == n {
+						dir = targets[i]
+					}
+				}
+				return func() ([]string, error) { return filepath.Glob(filepath.Join(dir, "planb-*.snap")) }
+			}
+
+			Expect(leader.Cmd("SET", "key", "v1")).To(Equal("OK"))
+			Eventually(backups(leader), "2s").Should(HaveLen(1))
+			Expect(leader.Cmd("SET", "key", "v2")).To(Equal("OK"))
+			Eventually(backups(leader), "2s").Should(HaveLen(2))
+			Expect(leader.Cmd("SET", "key", "v3")).To(Equal("OK"))
+			Eventually(func() ([]byte, error) {
+				names, err := backups(leader)()
+				if err != nil || len(names) == 0 {
+					return nil, err
+				}
+				return ioutil.ReadFile(names[len(names)-1])
+			}, "2s").Should(ContainSubstring("v3"))
+			Expect(backups(leader)()).To(HaveLen(2))
+			Expect(backups(follower)()).To(BeEmpty())
+			Expect(leader.Cmd("INFO")).To(ContainSubstring("backup_last_status:ok\n"))
+
+			// restore the latest backup into a fresh cluster
+			names, err := backups(leader)()
+			Expect(err).NotTo(HaveOccurred())
+
+			node, err := newTestNode()
+			Expect(err).NotTo(HaveOccurred())
+			defer node.Close()
+
+			Expect(node.Cmd("raft", "bootstrap", node.Addr())).To(Equal("OK"))
+			Eventually(func() (string, error) { return node.Cmd("raft", "state") }, "5s").Should(Equal("leader"))
+			Expect(node.srv.RestoreFile(names[len(names)-1])).To(Succeed())
+			Expect(node.Cmd("GET", "key")).To(Equal("v3"))
+		}))
+	})
+
 })
 
 // --------------------------------------------------------------------
@@ -103,16 +683,18 @@ type testNode struct {
 }
 
 func newTestNode() (*testNode, error) {
-	var err error
-
-	node := &testNode{kvs: planb.NewInmemStore()}
-	node.dir, err = ioutil.TempDir("", "planb-test-node")
+	lis, err := net.Listen("tcp", "127.0.0.1:")
 	if err != nil {
-		node.Close()
 		return nil, err
 	}
+	return newConfiguredTestNode(lis, nil)
+}
+
+func newConfiguredTestNode(lis net.Listener, configure func(*planb.Config)) (*testNode, error) {
+	var err error
 
-	node.lis, err = net.Listen("tcp", "127.0.0.1:")
+	node := &testNode{lis: lis, kvs: planb.NewInmemStore()}
+	node.dir, err = ioutil.TempDir("", "planb-test-node")
 	if err != nil {
 		node.Close()
 		return nil, err
@@ -120,6 +702,10 @@ func newTestNode() (*testNode, error) {
 
 	conf := planb.NewConfig()
 	conf.Raft.LogOutput = ioutil.Discard
+	conf.Cluster.RetryInterval = 100 * time.Millisecond
+	if configure != nil {
+		configure(conf)
+	}
 
 	node.srv, err = planb.NewServer(raft.ServerAddress(node.Addr()), node.dir, node.kvs, raft.NewInmemStore(), raft.NewInmemStore(), conf)
 	if err != nil {
@@ -134,7 +720,13 @@ func newTestNode() (*testNode, error) {
 	}
 
 	node.srv.HandleRW("set", nil, redeo.WrapperFunc(node.handleSet))
+	node.srv.HandleRW("fset", &planb.HandlerOpts{ForwardToLeader: true}, redeo.WrapperFunc(node.handleSet))
+	node.srv.HandleRWContext("meta", nil, planb.ContextHandlerFunc(node.handleMeta))
+	node.srv.HandleRWContext("setex", nil, planb.ContextHandlerFunc(node.handleSetEx))
+	node.srv.HandleRWContext("rset", nil, planb.ContextHandlerFunc(node.handleRandSet))
 	node.srv.HandleRO("get", nil, redeo.WrapperFunc(node.handleGet))
+	node.srv.HandleRO("lget", &planb.HandlerOpts{Consistency: planb.ConsistencyLinearizable}, redeo.WrapperFunc(node.handleGet))
+	node.srv.HandleRO("bget", &planb.HandlerOpts{Consistency: planb.ConsistencyBounded, MaxLagEntries: 10}, redeo.WrapperFunc(node.handleGet))
 
 	go node.srv.Serve(node.lis)
 	return node, err
@@ -170,6 +762,33 @@ func (n *testNode) Cmd(name string, args ...string) (string, error) {
 	}
 }
 
+func (n *testNode) Peers() ([]string, error) {
+	future := n.srv.Raft().GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, s := range future.Configuration().Servers {
+		addrs = append(addrs, string(s.Address))
+	}
+	return addrs, nil
+}
+
+func (n *testNode) Member(addr string) (*raft.Server, error) {
+	future := n.srv.Raft().GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range future.Configuration().Servers {
+		if string(s.Address) == addr {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find member %s", addr)
+}
+
 func (n *testNode) Close() {
 	if n.cln != nil {
 		_ = n.cln.Close()
@@ -199,6 +818,41 @@ func (n *testNode) handleSet(cmd *resp.Command) interface{} {
 	return "OK"
 }
 
+func (n *testNode) handleMeta(ctx context.Context, w resp.ResponseWriter, cmd *resp.Command) {
+	meta := planb.LogMetaFromContext(ctx)
+	w.AppendBulkString(fmt.Sprintf("index:%d term:%d replay:%v", meta.Index, meta.Term, meta.Replay))
+}
+
+func (n *testNode) handleSetEx(ctx context.Context, w resp.ResponseWriter, cmd *resp.Command) {
+	if len(cmd.Args) != 3 {
+		w.AppendError(redeo.WrongNumberOfArgs(cmd.Name))
+		return
+	}
+
+	msec, err := cmd.Arg(1).Int()
+	if err != nil {
+		w.AppendError("ERR " + err.Error())
+		return
+	}
+
+	meta := planb.LogMetaFromContext(ctx)
+	if err := n.kvs.PutWithTTL(cmd.Arg(0), cmd.Arg(2), time.Duration(msec)*time.Millisecond, meta.Time); err != nil {
+		w.AppendError("ERR " + err.Error())
+		return
+	}
+	w.AppendOK()
+}
+
+func (n *testNode) handleRandSet(ctx context.Context, w resp.ResponseWriter, cmd *resp.Command) {
+	meta := planb.LogMetaFromContext(ctx)
+	val := fmt.Sprintf("%d:%d", meta.Time.UnixNano(), meta.Rand().Int63())
+	if err := n.kvs.Put(cmd.Arg(0), []byte(val)); err != nil {
+		w.AppendError("ERR " + err.Error())
+		return
+	}
+	w.AppendOK()
+}
+
 func (n *testNode) handleGet(cmd *resp.Command) interface{} {
 	if len(cmd.Args) != 1 {
 		return redeo.ErrWrongNumberOfArgs(cmd.Name)
@@ -0,0 +1,219 @@
+package planb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/resp"
+	"github.com/hashicorp/raft"
+)
+
+// Leadership is transferred natively by raft: the leader brings the target
+// up to date and asks it to start an election immediately, so the cluster
+// is never without a leader for longer than the transfer takes.
+const (
+	transferPollDelay = 10 * time.Millisecond
+
+	// maxTransferBackoff limits the delay of leader preference
+	// checks after failed transfers.
+	maxTransferBackoff = 5 * time.Minute
+)
+
+var (
+	errLastVoter      = errors.New("node is the last voter")
+	errNotVoter       = errors.New("node is not a voter")
+	errTransferFailed = errors.New("unable to transfer leadership")
+)
+
+// transferLeadership makes the local leader transfer leadership to target,
+// or to the most up to date voter if target is nil. It awaits the new leader
+// and returns its address. errTransferFailed is returned if another node
+// than target is elected.
+func (s *Server) transferLeadership(target *raft.Server) (raft.ServerAddress, error) {
+	if s.ctrl.State() != raft.Leader {
+		return "", raft.ErrNotLeader
+	} else if target != nil && target.Address == s.addr {
+		return s.addr, nil
+	}
+
+	var future raft.Future
+	if target == nil {
+		future = s.ctrl.LeadershipTransfer()
+	} else {
+		future = s.ctrl.LeadershipTransferToServer(target.ID, target.Address)
+	}
+	if err := future.Error(); err != nil {
+		return "", err
+	}
+
+	leader, err := s.awaitLeader(func(addr raft.ServerAddress) bool { return addr != s.addr })
+	if err != nil {
+		return "", err
+	} else if target != nil && leader != target.Address {
+		return "", errTransferFailed
+	}
+	return leader, nil
+}
+
+// awaitLeader waits until a leader is known which satisfies accept.
+func (s *Server) awaitLeader(accept func(raft.ServerAddress) bool) (raft.ServerAddress, error) {
+	deadline := time.Now().Add(membershipTimeout)
+	for time.Now().Before(deadline) {
+		if leader := s.ctrl.Leader(); leader != "" && accept(leader) {
+			return leader, nil
+		}
+		time.Sleep(transferPollDelay)
+	}
+	return "", errNoLeader
+}
+
+func (s *Server) stepDown(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 0 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	leader, err := s.transferLeadership(nil)
+	if err != nil {
+		w.AppendErrorf("ERR unable to step down: %s", err.Error())
+		return
+	}
+	w.AppendBulkString(string(leader))
+}
+
+// transferLeader handles RAFT TRANSFER-LEADER [id|addr], it
+// must be served by the leader, see leaderRaftCmd.
+func (s *Server) transferLeader(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() > 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	var target *raft.Server
+	if c.ArgN() == 1 {
+		future := s.ctrl.GetConfiguration()
+		if err := future.Error(); err != nil {
+			w.AppendError("ERR " + err.Error())
+			return
+		}
+
+		name := c.Arg(0).String()
+		for _, srv := range future.Configuration().Servers {
+			if string(srv.ID) == name || string(srv.Address) == name {
+				srv := srv
+				target = &srv
+				break
+			}
+		}
+
+		if target == nil {
+			w.AppendErrorf("ERR unknown server %s", name)
+			return
+		} else if target.Suffrage != raft.Voter {
+			w.AppendErrorf("ERR unable to transfer leadership: %s", errNotVoter.Error())
+			return
+		}
+	}
+
+	leader, err := s.transferLeadership(target)
+	if err != nil {
+		w.AppendErrorf("ERR unable to transfer leadership: %s", err.Error())
+		return
+	}
+	w.AppendBulkString(string(leader))
+}
+
+// countVoters returns the number of voters in conf, except for id.
+func countVoters(conf raft.Configuration, id raft.ServerID) int {
+	var n int
+	for _, srv := range conf.Servers {
+		if srv.ID != id && srv.Suffrage == raft.Voter {
+			n++
+		}
+	}
+	return n
+}
+
+// --------------------------------------------------------------------
+
+// leaderPreference runs on every node. While the node is the leader, it
+// periodically compares its own leader priority with the priorities of the
+// voters which the autopilot tracks. Once a healthy voter has a higher
+// priority, leadership is transferred to it. Checks back off exponentially
+// after failed transfers.
+type leaderPreference struct {
+	s        *Server
+	interval time.Duration
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func newLeaderPreference(s *Server, interval time.Duration) *leaderPreference {
+	p := &leaderPreference{
+		s:        s,
+		interval: interval,
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+// Close stops the checks.
+func (p *leaderPreference) Close() error {
+	close(p.closing)
+	<-p.closed
+	return nil
+}
+
+func (p *leaderPreference) loop() {
+	defer close(p.closed)
+
+	backoff := p.interval
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-timer.C:
+		}
+
+		if p.s.ctrl.State() != raft.Leader || p.check() == nil {
+			backoff = p.interval
+		} else if backoff < maxTransferBackoff {
+			backoff *= 2
+		}
+		timer.Reset(backoff)
+	}
+}
+
+func (p *leaderPreference) check() error {
+	target := p.preferred(p.s.pilot.Servers())
+	if target == nil {
+		return nil
+	}
+
+	return p.s.ctrl.LeadershipTransferToServer(target.ID, target.Address).Error()
+}
+
+// preferred returns the healthy voter with the highest priority, if it
+// exceeds the priority of the local node. Ties are broken by address.
+func (p *leaderPreference) preferred(servers []serverHealth) *raft.Server {
+	var target *raft.Server
+	priority := p.s.priority
+
+	for _, h := range servers {
+		if h.ID == p.s.id || h.Suffrage != raft.Voter || !h.Healthy {
+			continue
+		}
+		if h.Priority > priority {
+			srv := h.Server
+			target, priority = &srv, h.Priority
+		}
+	}
+	return target
+}
@@ -0,0 +1,39 @@
+package planb
+
+import (
+	"github.com/hashicorp/raft"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("leaderPreference", func() {
+	var subject *leaderPreference
+	var servers []serverHealth
+
+	BeforeEach(func() {
+		subject = &leaderPreference{s: &Server{id: "a", priority: 10}}
+		servers = []serverHealth{
+			{Server: raft.Server{ID: "a", Address: "10.0.0.1:7230"}, Healthy: true, Priority: 10},
+			{Server: raft.Server{ID: "b", Address: "10.0.0.2:7230"}, Healthy: true, Priority: 5},
+			{Server: raft.Server{ID: "c", Address: "10.0.0.3:7230"}, Healthy: true, Priority: 10},
+			{Server: raft.Server{ID: "d", Address: "10.0.0.4:7230"}, Healthy: true, Priority: 0},
+		}
+	})
+
+	It("should keep leadership without higher priorities", func() {
+		Expect(subject.preferred(servers)).To(BeNil())
+	})
+
+	It("should prefer healthy voters with the highest priority", func() {
+		servers[1].Priority = 20
+		servers[2].Priority = 30
+		servers[3].Priority = 30
+		Expect(subject.preferred(servers)).To(Equal(&servers[2].Server))
+
+		servers[2].Healthy = false
+		Expect(subject.preferred(servers)).To(Equal(&servers[3].Server))
+
+		servers[3].Suffrage = raft.Nonvoter
+		Expect(subject.preferred(servers)).To(Equal(&servers[1].Server))
+	})
+})
@@ -0,0 +1,336 @@
+package planb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/resp"
+	"github.com/hashicorp/raft"
+)
+
+type ctxKeyTx struct{}
+
+// txState holds the per-connection MULTI/EXEC state. Transactions are
+// applied atomically, but WATCH is not supported, there is no optimistic
+// locking.
+type txState struct {
+	active  bool
+	cmds    [][]byte        // encoded commands
+	locals  []redeo.Handler // handlers of local commands, nil if replicated
+	timeout time.Duration
+	forward bool // true unless a mutating command may not be forwarded
+	err     error
+}
+
+// getTx returns the transaction state of the client connection
+// that issued the command, may return nil.
+func getTx(c *resp.Command) *txState {
+	if client := redeo.GetClient(c.Context()); client != nil {
+		tx, _ := client.Context().Value(ctxKeyTx{}).(*txState)
+		return tx
+	}
+	return nil
+}
+
+// Active returns true if a transaction was started.
+func (tx *txState) Active() bool { return tx != nil && tx.active }
+
+// Queue encodes and queues a replicated, mutating command.
+func (tx *txState) Queue(w resp.ResponseWriter, codec Codec, opt *HandlerOpts, c *resp.Command) {
+	if tx.QueueRead(w, codec, opt, c) && !opt.forwardToLeader() {
+		tx.forward = false
+	}
+}
+
+// QueueRead encodes and queues a replicated, read-only command.
+func (tx *txState) QueueRead(w resp.ResponseWriter, codec Codec, opt *HandlerOpts, c *resp.Command) bool {
+	if !tx.queue(w, codec, c, nil) {
+		return false
+	}
+
+	if timeout := opt.getTimeout(); timeout > tx.timeout {
+		tx.timeout = timeout
+	}
+	return true
+}
+
+// QueueLocal encodes and queues a command which is
+// served by the local node, through h, on EXEC.
+func (tx *txState) QueueLocal(w resp.ResponseWriter, codec Codec, c *resp.Command, h redeo.Handler) {
+	tx.queue(w, codec, c, h)
+}
+
+func (tx *txState) queue(w resp.ResponseWriter, codec Codec, c *resp.Command, local redeo.Handler) bool {
+	buf := new(bytes.Buffer)
+	if err := codec.Encode(buf, c); err != nil {
+		tx.Fail(w, "ERR "+err.Error())
+		return false
+	}
+
+	tx.cmds = append(tx.cmds, buf.Bytes())
+	tx.locals = append(tx.locals, local)
+	w.AppendInlineString("QUEUED")
+	return true
+}
+
+// Replicated returns the replicated commands.
+func (tx *txState) Replicated() [][]byte {
+	cmds := make([][]byte, 0, len(tx.cmds))
+	for i, cmd := range tx.cmds {
+		if tx.locals[i] == nil {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// HasLocal returns true if local commands were queued.
+func (tx *txState) HasLocal() bool {
+	for _, h := range tx.locals {
+		if h != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Fail rejects a command. If a transaction is active,
+// it will be aborted on EXEC.
+func (tx *txState) Fail(w resp.ResponseWriter, msg string) {
+	if tx.Active() {
+		tx.err = errors.New(msg)
+	}
+	w.AppendError(msg)
+}
+
+func (tx *txState) reset() {
+	tx.active = false
+	tx.cmds = nil
+	tx.locals = nil
+	tx.timeout = 0
+	tx.forward = false
+	tx.err = nil
+}
+
+// --------------------------------------------------------------------
+
+// queueingHandler wraps read-only handlers and
+// queues commands when a transaction is active.
+type queueingHandler struct {
+	s *Server
+	o *HandlerOpts
+	h redeo.Handler
+}
+
+func (h queueingHandler) ServeRedeo(w resp.ResponseWriter, c *resp.Command) {
+	tx := getTx(c)
+	if !h.o.validArity(c) {
+		tx.Fail(w, redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+	if tx.Active() {
+		tx.QueueRead(w, h.s.codec, h.o, c)
+		return
+	}
+	h.h.ServeRedeo(w, c)
+}
+
+// localHandler wraps commands which are served by the local
+// node and queues them when a transaction is active.
+type localHandler struct {
+	s *Server
+	h redeo.Handler
+}
+
+func (h localHandler) ServeRedeo(w resp.ResponseWriter, c *resp.Command) {
+	if tx := getTx(c); tx.Active() {
+		tx.QueueLocal(w, h.s.codec, c, h.h)
+		return
+	}
+	h.h.ServeRedeo(w, c)
+}
+
+// nonTxHandler wraps commands which cannot be
+// queued and rejects them within transactions.
+type nonTxHandler struct {
+	h redeo.Handler
+}
+
+func (h nonTxHandler) ServeRedeo(w resp.ResponseWriter, c *resp.Command) {
+	if tx := getTx(c); tx.Active() {
+		tx.Fail(w, "ERR "+c.Name+" is not allowed in transactions")
+		return
+	}
+	h.h.ServeRedeo(w, c)
+}
+
+// --------------------------------------------------------------------
+
+func (s *Server) multi(w resp.ResponseWriter, c *resp.Command) {
+	client := redeo.GetClient(c.Context())
+	if client == nil {
+		w.AppendError("ERR MULTI is not supported")
+		return
+	}
+
+	tx, ok := client.Context().Value(ctxKeyTx{}).(*txState)
+	if !ok {
+		tx = new(txState)
+		client.SetContext(context.WithValue(client.Context(), ctxKeyTx{}, tx))
+	} else if tx.active {
+		w.AppendError("ERR MULTI calls can not be nested")
+		return
+	}
+
+	tx.active = true
+	tx.forward = true
+	w.AppendOK()
+}
+
+func (s *Server) discard(w resp.ResponseWriter, c *resp.Command) {
+	tx := getTx(c)
+	if !tx.Active() {
+		w.AppendError("ERR DISCARD without MULTI")
+		return
+	}
+
+	tx.reset()
+	w.AppendOK()
+}
+
+func (s *Server) exec(w resp.ResponseWriter, c *resp.Command) {
+	tx := getTx(c)
+	if !tx.Active() {
+		w.AppendError("ERR EXEC without MULTI")
+		return
+	}
+	defer tx.reset()
+
+	if tx.err != nil {
+		w.AppendError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	timeout := tx.timeout
+	if timeout == 0 {
+		timeout = (*HandlerOpts)(nil).getTimeout()
+	}
+
+	var res interface{}
+	if cmds := tx.Replicated(); len(cmds) != 0 {
+		// raft retains the encoded log entry, the buffer must not be recycled
+		buf := new(bytes.Buffer)
+		if err := encodeLogStamp(buf); err != nil {
+			w.AppendError("ERR " + err.Error())
+			return
+		}
+		encodeCommandsEntry(buf, logEntryMulti, cmds)
+
+		future := s.ctrl.Apply(buf.Bytes(), timeout)
+		switch err := future.Error(); err {
+		case raft.ErrNotLeader:
+			if tx.forward {
+				s.forwardTx(w, c, tx, timeout)
+				return
+			}
+			w.AppendError("READONLY " + err.Error())
+			return
+		default:
+			w.AppendError("ERR " + err.Error())
+			return
+		case nil:
+		}
+		res = future.Response()
+	}
+
+	if !tx.HasLocal() {
+		if res == nil {
+			w.AppendArrayLen(0)
+			return
+		}
+		appendResult(w, res)
+		return
+	}
+	s.appendTxResult(w, c, tx, res)
+}
+
+// forwardTx forwards a transaction to the leader.
+func (s *Server) forwardTx(w resp.ResponseWriter, c *resp.Command, tx *txState, timeout time.Duration) {
+	cmds := make([]*resp.Command, 0, len(tx.cmds)+2)
+	cmds = append(cmds, resp.NewCommand("MULTI"))
+	for _, data := range tx.cmds {
+		cmd := new(resp.Command)
+		if err := s.codec.Decode(data, cmd); err != nil {
+			w.AppendError("ERR " + err.Error())
+			return
+		}
+		cmds = append(cmds, cmd)
+	}
+	cmds = append(cmds, resp.NewCommand("EXEC"))
+
+	if err := s.fwd.ForwardAll(s.ctrl.Leader(), w, c, cmds, timeout); err == errNoLeader {
+		w.AppendError("READONLY " + raft.ErrNotLeader.Error())
+	} else if err != nil {
+		w.AppendErrorf("ERR unable to forward to leader: %s", err.Error())
+	}
+}
+
+// appendTxResult appends the result of a transaction with local commands.
+// These are served once the replicated commands have been applied, their
+// replies are merged in the order in which the commands were queued.
+func (s *Server) appendTxResult(w resp.ResponseWriter, c *resp.Command, tx *txState, res interface{}) {
+	var replies []interface{}
+	switch res := res.(type) {
+	case *bytes.Buffer:
+		v, err := readResponse(resp.NewResponseReader(res))
+		bufPool.Put(res)
+		if err != nil {
+			w.AppendError("ERR " + err.Error())
+			return
+		}
+		replies, _ = v.([]interface{})
+	case error:
+		w.AppendError("ERR " + res.Error())
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	result := make([]interface{}, 0, len(tx.cmds))
+	for i, data := range tx.cmds {
+		h := tx.locals[i]
+		if h == nil {
+			if len(replies) == 0 {
+				result = append(result, errorReply("ERR "+errUnexpectedServerResponse.Error()))
+				continue
+			}
+			result = append(result, replies[0])
+			replies = replies[1:]
+			continue
+		}
+
+		var cmd resp.Command
+		if err := s.codec.Decode(data, &cmd); err != nil {
+			result = append(result, errorReply("ERR "+err.Error()))
+			continue
+		}
+		cmd.SetContext(c.Context())
+
+		buf.Reset()
+		lw := resp.NewResponseWriter(buf)
+		h.ServeRedeo(lw, &cmd)
+		if err := lw.Flush(); err != nil {
+			result = append(result, errorReply("ERR "+err.Error()))
+			continue
+		}
+
+		reply, err := readResponse(resp.NewResponseReader(buf))
+		if err != nil {
+			reply = errorReply("ERR " + err.Error())
+		}
+		result = append(result, reply)
+	}
+	appendResponse(w, result)
+}
@@ -0,0 +1,313 @@
+package planb
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/resp"
+)
+
+var errInvalidFrame = errors.New("planb: invalid request frame")
+
+const (
+	pipelineMinRead     = 4096
+	pipelineMaxBuffered = resp.MaxBufferSize
+	pipelineMaxDeferred = resp.MaxBufferSize
+)
+
+// pipelineListener wraps accepted connections, allowing
+// handlers to read ahead pipelined commands.
+type pipelineListener struct{ net.Listener }
+
+func (l pipelineListener) Accept() (net.Conn, error) {
+	cn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &pipelineConn{Conn: cn}, nil
+}
+
+// pipelineAddr is the remote address of a pipelineConn. It is the only
+// handle on the connection which redeo exposes to handlers.
+type pipelineAddr struct {
+	net.Addr
+	cn *pipelineConn
+}
+
+// pipelineConn passes on buffered requests one command at a time, so
+// pipelined commands remain visible to handlers, see ReadAhead. Writes are
+// deferred while buffered requests remain, in order to retain the benefit
+// of pipelining.
+type pipelineConn struct {
+	net.Conn
+
+	buf   []byte // buffered input, from pos
+	pos   int
+	frame int  // buffered bytes of the current command, which may be passed on
+	raw   bool // true after a protocol error, input is passed on as is
+	scan  frameScanner
+
+	pending int32 // atomic, number of buffered bytes
+
+	mu  sync.Mutex // protects out
+	out []byte     // deferred output
+}
+
+// getPipelineConn returns the connection of the client
+// that issued the command, may return nil.
+func getPipelineConn(c *resp.Command) *pipelineConn {
+	if client := redeo.GetClient(c.Context()); client != nil {
+		if addr, ok := client.RemoteAddr().(pipelineAddr); ok {
+			return addr.cn
+		}
+	}
+	return nil
+}
+
+// RemoteAddr implements net.Conn.
+func (c *pipelineConn) RemoteAddr() net.Addr {
+	return pipelineAddr{Addr: c.Conn.RemoteAddr(), cn: c}
+}
+
+// Read implements net.Conn.
+func (c *pipelineConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for c.frame == 0 {
+		if c.raw {
+			c.frame = len(c.buf) - c.pos
+		} else if n, _, err := c.scan.Advance(c.buf[c.pos:]); err != nil {
+			c.raw = true
+			continue
+		} else {
+			c.frame = n
+		}
+
+		if c.frame == 0 {
+			if err := c.fill(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n := copy(p, c.buf[c.pos:c.pos+c.frame])
+	c.frame -= n
+	c.consume(n)
+	return n, nil
+}
+
+// Write implements net.Conn.
+func (c *pipelineConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if atomic.LoadInt32(&c.pending) != 0 && len(c.out)+len(p) <= pipelineMaxDeferred {
+		c.out = append(c.out, p...)
+		return len(p), nil
+	}
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// Close implements net.Conn.
+func (c *pipelineConn) Close() error {
+	c.mu.Lock()
+	_ = c.flush()
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// ReadAhead consumes up to limit complete, buffered commands, which have
+// not been passed on yet. It stops at the first command which is not
+// accepted. It must only be called by handlers, once the current
+// command has been read.
+func (c *pipelineConn) ReadAhead(limit int, accept func(*resp.Command) bool) []*resp.Command {
+	if c.raw || c.frame != 0 || !c.scan.Idle() {
+		return nil
+	}
+
+	var cmds []*resp.Command
+	for len(cmds) < limit {
+		var scan frameScanner
+		n, end, err := scan.Advance(c.buf[c.pos:])
+		if err != nil || !end {
+			break
+		}
+
+		cmd, ok := parseFrame(c.buf[c.pos : c.pos+n])
+		if !ok || !accept(cmd) {
+			break
+		}
+		cmds = append(cmds, cmd)
+		c.consume(n)
+	}
+	return cmds
+}
+
+// fill flushes deferred output and reads more input.
+func (c *pipelineConn) fill() error {
+	c.mu.Lock()
+	err := c.flush()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if c.pos != 0 {
+		c.buf = c.buf[:copy(c.buf, c.buf[c.pos:])]
+		c.pos = 0
+	}
+	if len(c.buf) >= pipelineMaxBuffered {
+		c.raw = true // headers exceed the limit, give up
+		return nil
+	}
+	if cap(c.buf)-len(c.buf) < pipelineMinRead {
+		buf := make([]byte, len(c.buf), 2*cap(c.buf)+pipelineMinRead)
+		copy(buf, c.buf)
+		c.buf = buf
+	}
+
+	n, err := c.Conn.Read(c.buf[len(c.buf):cap(c.buf)])
+	c.buf = c.buf[:len(c.buf)+n]
+	atomic.AddInt32(&c.pending, int32(n))
+	if n != 0 {
+		return nil
+	}
+	return err
+}
+
+// consume discards n buffered bytes.
+func (c *pipelineConn) consume(n int) {
+	c.pos += n
+	atomic.AddInt32(&c.pending, -int32(n))
+}
+
+// flush writes deferred output, requires a lock.
+func (c *pipelineConn) flush() error {
+	if len(c.out) == 0 {
+		return nil
+	}
+
+	_, err := c.Conn.Write(c.out)
+	c.out = c.out[:0]
+	return err
+}
+
+// --------------------------------------------------------------------
+
+// frameScanner finds the boundaries of request frames.
+type frameScanner struct {
+	started bool
+	args    int // remaining bulk arguments
+	skip    int // remaining bytes of the current argument
+}
+
+// Idle returns true if the scanner is at a frame boundary.
+func (s *frameScanner) Idle() bool { return !s.started && s.skip == 0 }
+
+// Advance returns the number of bytes at the start of p which belong to the
+// current frame and whether the frame ends after them.
+func (s *frameScanner) Advance(p []byte) (int, bool, error) {
+	n := 0
+	for {
+		if s.skip != 0 {
+			k := s.skip
+			if k > len(p)-n {
+				k = len(p) - n
+			}
+			n += k
+			if s.skip -= k; s.skip != 0 {
+				return n, false, nil
+			}
+			if s.args == 0 {
+				s.started = false
+				return n, true, nil
+			}
+		}
+
+		i := bytes.IndexByte(p[n:], '\n')
+		if i < 0 {
+			return n, false, nil
+		}
+		line := p[n : n+i+1]
+		n += i + 1
+
+		if !s.started {
+			if line[0] != '*' {
+				return n, true, nil // inline command
+			}
+			size, err := parseFrameHeader(line)
+			if err != nil {
+				return n, false, err
+			} else if size < 1 {
+				return n, true, nil
+			}
+			s.started, s.args = true, size
+			continue
+		}
+
+		if line[0] != '$' {
+			return n, false, errInvalidFrame
+		}
+		size, err := parseFrameHeader(line)
+		if err != nil || size < 0 {
+			return n, false, errInvalidFrame
+		}
+		s.args--
+		s.skip = size + 2
+	}
+}
+
+// parseFrame parses a complete, multi-bulk frame.
+func parseFrame(p []byte) (*resp.Command, bool) {
+	var args [][]byte
+	for len(p) != 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			return nil, false
+		}
+		size, err := parseFrameHeader(p[:i+1])
+		if err != nil {
+			return nil, false
+		}
+
+		if p[0] == '*' {
+			p = p[i+1:]
+			continue
+		}
+		if p[0] != '$' || size < 0 || i+1+size+2 > len(p) {
+			return nil, false
+		}
+		args = append(args, append([]byte(nil), p[i+1:i+1+size]...))
+		p = p[i+1+size+2:]
+	}
+	if len(args) == 0 {
+		return nil, false
+	}
+
+	cargs := make([]resp.CommandArgument, len(args)-1)
+	for i, arg := range args[1:] {
+		cargs[i] = arg
+	}
+	return resp.NewCommand(string(args[0]), cargs...), true
+}
+
+// parseFrameHeader parses the size of a "*<n>\r\n" or "$<n>\r\n" line.
+func parseFrameHeader(line []byte) (int, error) {
+	line = bytes.TrimRight(line[1:], "\r\n")
+	n, err := strconv.Atoi(string(line))
+	if err != nil {
+		return 0, errInvalidFrame
+	}
+	return n, nil
+}
@@ -0,0 +1,152 @@
+package planb
+
+import (
+	"io"
+	"net"
+	"strings"
+
+	"github.com/bsm/redeo/resp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("frameScanner", func() {
+	var subject *frameScanner
+
+	BeforeEach(func() {
+		subject = new(frameScanner)
+	})
+
+	var advance = func(s string) (int, bool) {
+		n, end, err := subject.Advance([]byte(s))
+		Expect(err).NotTo(HaveOccurred())
+		return n, end
+	}
+
+	It("should find frame boundaries", func() {
+		n, end := advance("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n*1\r\n")
+		Expect(n).To(Equal(22))
+		Expect(end).To(BeTrue())
+		Expect(subject.Idle()).To(BeTrue())
+
+		n, end = advance("PING\r\n*1\r\n")
+		Expect(n).To(Equal(6))
+		Expect(end).To(BeTrue())
+
+		n, end = advance("*0\r\n")
+		Expect(n).To(Equal(4))
+		Expect(end).To(BeTrue())
+	})
+
+	It("should scan fragmented frames", func() {
+		n, end := advance("*2\r\n$3\r\nGE")
+		Expect(n).To(Equal(10))
+		Expect(end).To(BeFalse())
+		Expect(subject.Idle()).To(BeFalse())
+
+		n, end = advance("T\r\n$")
+		Expect(n).To(Equal(3))
+		Expect(end).To(BeFalse())
+
+		n, end = advance("$3\r\nkey\r\n")
+		Expect(n).To(Equal(9))
+		Expect(end).To(BeTrue())
+		Expect(subject.Idle()).To(BeTrue())
+	})
+
+	It("should reject invalid frames", func() {
+		_, _, err := subject.Advance([]byte("*x\r\n"))
+		Expect(err).To(MatchError(errInvalidFrame))
+
+		subject = new(frameScanner)
+		_, _, err = subject.Advance([]byte("*1\r\n+OK\r\n"))
+		Expect(err).To(MatchError(errInvalidFrame))
+	})
+})
+
+var _ = Describe("parseFrame", func() {
+	It("should parse commands", func() {
+		cmd, ok := parseFrame([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n"))
+		Expect(ok).To(BeTrue())
+		Expect(cmd.Name).To(Equal("SET"))
+		Expect(cmd.ArgN()).To(Equal(2))
+		Expect(cmd.Arg(0).String()).To(Equal("key"))
+		Expect(cmd.Arg(1)).To(BeEmpty())
+
+		_, ok = parseFrame([]byte("PING\r\n"))
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("pipelineConn", func() {
+	var subject *pipelineConn
+	var client net.Conn
+
+	BeforeEach(func() {
+		var server net.Conn
+		server, client = net.Pipe()
+		subject = &pipelineConn{Conn: server}
+	})
+
+	AfterEach(func() {
+		Expect(client.Close()).To(Succeed())
+		Expect(subject.Close()).To(Succeed())
+	})
+
+	var send = func(s string) {
+		go func() {
+			defer GinkgoRecover()
+
+			_, err := io.WriteString(client, s)
+			Expect(err).NotTo(HaveOccurred())
+		}()
+	}
+
+	var read = func(n int) string {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(subject, buf)
+		Expect(err).NotTo(HaveOccurred())
+		return string(buf)
+	}
+
+	It("should pass on one command at a time", func() {
+		send("*1\r\n$4\r\nPING\r\nPING\r\n*1\r\n$4\r\nPING\r\n")
+
+		buf := make([]byte, 64)
+		Expect(subject.Read(buf)).To(Equal(14))
+		Expect(subject.Read(buf)).To(Equal(6))
+		Expect(subject.Read(buf)).To(Equal(14))
+	})
+
+	It("should read ahead pipelined commands", func() {
+		send("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nSET\r\n$1\r\na\r\n*2\r\n$3\r\nSET\r\n$1\r\nb\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n")
+		Expect(read(14)).To(Equal("*1\r\n$4\r\nPING\r\n"))
+
+		var names []string
+		cmds := subject.ReadAhead(8, func(cmd *resp.Command) bool {
+			names = append(names, cmd.Name)
+			return strings.EqualFold(cmd.Name, "SET")
+		})
+		Expect(cmds).To(HaveLen(2))
+		Expect(names).To(Equal([]string{"SET", "SET", "GET"}))
+		Expect(read(20)).To(Equal("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	})
+
+	It("should defer writes while commands are buffered", func() {
+		send("*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n")
+		Expect(read(14)).To(Equal("*1\r\n$4\r\nPING\r\n"))
+
+		Expect(subject.Write([]byte("+PONG\r\n"))).To(Equal(7))
+		Expect(subject.out).To(HaveLen(7))
+
+		Expect(read(14)).To(Equal("*1\r\n$4\r\nPING\r\n"))
+		done := make(chan string, 1)
+		go func() {
+			buf := make([]byte, 14)
+			_, _ = io.ReadFull(client, buf)
+			done <- string(buf)
+		}()
+		Expect(subject.Write([]byte("+PONG\r\n"))).To(Equal(7))
+		Eventually(done).Should(Receive(Equal("+PONG\r\n+PONG\r\n")))
+	})
+})
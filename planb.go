@@ -1,18 +1,81 @@
 package planb
 
 import (
+	"context"
 	"io"
+	"math/rand"
 	"time"
 
+	"github.com/bsm/redeo/resp"
 	"github.com/hashicorp/raft"
 )
 
+// ReadConsistency determines the consistency guarantees of read-only commands.
+type ReadConsistency uint8
+
+const (
+	// ConsistencyStale serves reads from the local store of any node,
+	// data may be arbitrarily stale. This is the default.
+	ConsistencyStale ReadConsistency = iota
+	// ConsistencyLeader only serves reads on the node that believes to be
+	// the leader. Reads are cheap but a deposed leader may still serve
+	// stale data for a short period of time.
+	ConsistencyLeader
+	// ConsistencyLinearizable only serves reads on the leader, after
+	// confirming leadership with a quorum of peers and waiting for
+	// all committed commands to be applied.
+	ConsistencyLinearizable
+	// ConsistencyBounded serves reads on the leader and on followers
+	// which are within the bounds set by HandlerOpts.MaxStaleness and
+	// HandlerOpts.MaxLagEntries.
+	ConsistencyBounded
+)
+
 // HandlerOpts contain options for handler execution.
 type HandlerOpts struct {
-	// Timeout is an optional timeout for mutating commands. It indicates
-	// the maximum duration the server is willing to wait for the application
-	// of the command. Minimum: 1s, default: 10s.
+	// Timeout is an optional timeout for mutating commands and linearizable reads.
+	// It indicates the maximum duration the server is willing to wait for the
+	// application of the command. Minimum: 1s, default: 10s.
 	Timeout time.Duration
+
+	// Consistency sets the consistency level of read-only commands.
+	// Default: ConsistencyStale.
+	Consistency ReadConsistency
+
+	// MaxStaleness is the maximum time since the last contact with the
+	// leader for a follower to serve reads with ConsistencyBounded.
+	// Minimum: 10ms, default: 1s.
+	MaxStaleness time.Duration
+
+	// MaxLagEntries is the maximum number of committed log entries a follower
+	// may lag behind before it refuses reads with ConsistencyBounded.
+	// Default: 0 (unchecked).
+	MaxLagEntries uint64
+
+	// ForwardToLeader enables transparent forwarding of commands. When set,
+	// followers proxy mutating commands and reads which require leadership
+	// to the current leader and relay the leader's reply back to the client
+	// instead of responding with an error.
+	ForwardToLeader bool
+
+	// Arity is the number of arguments the command accepts, following the
+	// Redis convention: it includes the command name and negative values
+	// indicate a minimum of -Arity. Calls with a different number of
+	// arguments are rejected before they are proposed or queued in a
+	// transaction. Default: 0 (unchecked).
+	Arity int
+}
+
+func (o *HandlerOpts) validArity(c *resp.Command) bool {
+	if o == nil || o.Arity == 0 {
+		return true
+	}
+
+	n := c.ArgN() + 1
+	if o.Arity < 0 {
+		return n >= -o.Arity
+	}
+	return n == o.Arity
 }
 
 func (o *HandlerOpts) getTimeout() time.Duration {
@@ -22,6 +85,102 @@ func (o *HandlerOpts) getTimeout() time.Duration {
 	return 10 * time.Second
 }
 
+func (o *HandlerOpts) getConsistency() ReadConsistency {
+	if o != nil {
+		return o.Consistency
+	}
+	return ConsistencyStale
+}
+
+func (o *HandlerOpts) getMaxStaleness() time.Duration {
+	if o != nil && o.MaxStaleness >= 10*time.Millisecond {
+		return o.MaxStaleness
+	}
+	return time.Second
+}
+
+func (o *HandlerOpts) getMaxLagEntries() uint64 {
+	if o != nil {
+		return o.MaxLagEntries
+	}
+	return 0
+}
+
+func (o *HandlerOpts) forwardToLeader() bool {
+	return o != nil && o.ForwardToLeader
+}
+
+// --------------------------------------------------------------------
+
+// LogMeta contains metadata of the replicated log
+// entry a mutating command is applied from.
+type LogMeta struct {
+	// Index is the index of the log entry.
+	Index uint64
+	// Term is the election term of the log entry.
+	Term uint64
+	// Replay is true when the entry is re-applied from the
+	// local log store after a restart.
+	Replay bool
+	// Time is the time at which the leader proposed the command.
+	// Handlers must use it instead of time.Now() to produce
+	// identical results on all nodes. It is zero for entries
+	// written by older versions.
+	Time time.Time
+	// Seed is a random seed generated by the leader when the command
+	// was proposed. It is unique to each command within a batch or
+	// transaction.
+	Seed int64
+
+	parent context.Context // optional, see IndexedStore.ApplyIndexed
+}
+
+// Rand returns a deterministic source of randomness, seeded with Seed.
+func (m *LogMeta) Rand() *rand.Rand {
+	return rand.New(rand.NewSource(m.Seed))
+}
+
+type ctxKeyLogMeta struct{}
+
+// context returns a command context for the n-th command of the entry
+func (m *LogMeta) context(n int) context.Context {
+	parent := m.parent
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	meta := *m
+	meta.Seed += int64(n)
+	meta.parent = nil
+	return context.WithValue(parent, ctxKeyLogMeta{}, &meta)
+}
+
+// LogMetaFromContext extracts the log metadata from a command context.
+// Returns nil when the command is not applied from the replicated log.
+func LogMetaFromContext(ctx context.Context) *LogMeta {
+	if ctx != nil {
+		if meta, ok := ctx.Value(ctxKeyLogMeta{}).(*LogMeta); ok {
+			return meta
+		}
+	}
+	return nil
+}
+
+// ContextHandler handles mutating commands with access to the
+// replication context, see LogMetaFromContext.
+type ContextHandler interface {
+	// ServeRedeoContext serves a command.
+	ServeRedeoContext(ctx context.Context, w resp.ResponseWriter, c *resp.Command)
+}
+
+// ContextHandlerFunc is a callback function, implementing ContextHandler.
+type ContextHandlerFunc func(ctx context.Context, w resp.ResponseWriter, c *resp.Command)
+
+// ServeRedeoContext implements ContextHandler
+func (f ContextHandlerFunc) ServeRedeoContext(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	f(ctx, w, c)
+}
+
 // --------------------------------------------------------------------
 
 // Store is an abstraction of an underlying
@@ -34,6 +193,66 @@ type Store interface {
 	Snapshot(w io.Writer) error
 }
 
+// Snapshotter is an optional Store extension. Stores which implement it
+// produce snapshots that reflect the exact state at the raft index the
+// snapshot is labelled with.
+type Snapshotter interface {
+	Store
+	// Freeze returns a point-in-time view of the store. It is never
+	// called concurrently with the application of commands.
+	Freeze() (StoreSnapshot, error)
+}
+
+// StoreSnapshot is a frozen, point-in-time view of a store.
+type StoreSnapshot interface {
+	// Persist writes the snapshot to w, in a format
+	// which can be loaded via Store.Restore.
+	Persist(w io.Writer) error
+	// Release is invoked when the snapshot is no longer needed.
+	Release()
+}
+
+// ExpiringStore is a Store which supports key expiration. Expired
+// keys are periodically removed by the leader, through the
+// replicated log.
+type ExpiringStore interface {
+	Store
+	// ExpiredKeys returns up to limit keys which have expired at the given time.
+	ExpiredKeys(now time.Time, limit int) [][]byte
+	// DeleteExpired deletes the given keys, if they have expired at the given time.
+	DeleteExpired(keys [][]byte, now time.Time) error
+}
+
+// IndexedStore is an optional Store extension for durable stores. Stores
+// which implement it keep track of the last applied log index, entries
+// and snapshots up to that index are not re-applied when the log is
+// replayed after a restart.
+type IndexedStore interface {
+	Store
+	// AppliedIndex returns the index of the last applied log entry.
+	AppliedIndex() uint64
+	// ApplyIndexed is called for each log entry. The changes made by
+	// apply must be persisted atomically with the applied index. The
+	// context passed to apply may carry store state, such as a write
+	// transaction, it is the parent of all command contexts of the entry.
+	ApplyIndexed(index uint64, apply func(context.Context)) error
+	// RestoreIndexed restores the store from a data stream, like Restore,
+	// and atomically resets the applied index to the index of the snapshot.
+	RestoreIndexed(r io.Reader, index uint64) error
+}
+
+// BackupTarget stores backups, e.g. in a local directory or in an object
+// store. Backups are snapshot exports and can be restored into a fresh
+// cluster with Server.RestoreFile.
+type BackupTarget interface {
+	// Put stores a backup under name.
+	Put(name string, r io.Reader) error
+	// List returns the names of all stored backups.
+	List() ([]string, error)
+	// Delete removes a stored backup.
+	Delete(name string) error
+}
+
 // RaftCtrl is an interface to the underlying raft node controller
 type RaftCtrl interface {
 	// AppliedIndex returns the last index applied to the FSM.
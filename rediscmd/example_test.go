@@ -0,0 +1,26 @@
+package rediscmd_test
+
+import (
+	"github.com/bsm/planb"
+	"github.com/bsm/planb/rediscmd"
+	"github.com/hashicorp/raft"
+)
+
+func ExampleRegister() {
+	// Open a store
+	store := planb.NewInmemStore()
+
+	// Init server
+	srv, err := planb.NewServer("10.0.0.1:7230", ".", store, raft.NewInmemStore(), raft.NewInmemStore(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// Register standard commands, GET, SET, DEL, INCR, etc.
+	rediscmd.Register(srv, store, nil)
+
+	// Start serving
+	if err := srv.ListenAndServe(); err != nil {
+		panic(err)
+	}
+}
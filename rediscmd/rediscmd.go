@@ -0,0 +1,551 @@
+// Package rediscmd implements a standard set of Redis-compatible
+// string, key and counter commands for planb servers.
+package rediscmd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bsm/planb"
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/resp"
+)
+
+var (
+	errNotInteger       = errors.New("ERR value is not an integer or out of range")
+	errSyntax           = errors.New("ERR syntax error")
+	errInvalidExpire    = errors.New("ERR invalid expire time")
+	errExpiryNotSupport = errors.New("ERR store does not support expiry")
+)
+
+// Store is the minimal store interface required by the commands.
+type Store interface {
+	// Get retrieves a key, returns nil if the key does not exist.
+	Get(key []byte) ([]byte, error)
+	// Put sets a key, replacing any existing value and expiration.
+	Put(key, val []byte) error
+	// Delete deletes a key.
+	Delete(key []byte) error
+}
+
+// ExpiringStore is an optional Store extension. Stores which implement it
+// support the EX/PX options of SET as well as EXPIRE, PEXPIRE, TTL and PTTL.
+type ExpiringStore interface {
+	Store
+	// GetAt retrieves a key, unless it has expired at the given time.
+	GetAt(key []byte, now time.Time) ([]byte, error)
+	// PutWithTTL sets a key which expires after ttl, relative to now.
+	PutWithTTL(key, val []byte, ttl time.Duration, now time.Time) error
+	// Expire sets the expiration of an existing key of any type to ttl,
+	// relative to now. Returns false if the key does not exist.
+	Expire(key []byte, ttl time.Duration, now time.Time) (bool, error)
+	// TTL returns the remaining time to live of a key, -1 if the key has no
+	// associated expiration and -2 if it does not exist.
+	TTL(key []byte, now time.Time) (time.Duration, error)
+}
+
+// Register registers the following commands with the server:
+//
+//	strings:  GET, MGET, STRLEN, SET, SETNX, GETSET, MSET, APPEND
+//	counters: INCR, INCRBY, DECR, DECRBY
+//	keys:     DEL, EXISTS
+//
+// If the store implements ExpiringStore, it also registers EXPIRE, PEXPIRE,
+// TTL and PTTL. Options are applied to all commands, the arity of each
+// command is set automatically.
+func Register(srv *planb.Server, store Store, opt *planb.HandlerOpts) {
+	h := &handlers{store: store}
+	h.expiring, _ = store.(ExpiringStore)
+
+	srv.HandleRO("get", withArity(opt, 2), redeo.HandlerFunc(h.get))
+	srv.HandleRO("mget", withArity(opt, -2), redeo.HandlerFunc(h.mget))
+	srv.HandleRO("strlen", withArity(opt, 2), redeo.HandlerFunc(h.strlen))
+	srv.HandleRO("exists", withArity(opt, -2), redeo.HandlerFunc(h.exists))
+
+	srv.HandleRWContext("set", withArity(opt, -3), planb.ContextHandlerFunc(h.set))
+	srv.HandleRWContext("setnx", withArity(opt, 3), planb.ContextHandlerFunc(h.setnx))
+	srv.HandleRWContext("getset", withArity(opt, 3), planb.ContextHandlerFunc(h.getset))
+	srv.HandleRWContext("mset", withArity(opt, -3), planb.ContextHandlerFunc(h.mset))
+	srv.HandleRWContext("append", withArity(opt, 3), planb.ContextHandlerFunc(h.appendValue))
+	srv.HandleRWContext("incr", withArity(opt, 2), planb.ContextHandlerFunc(h.incr))
+	srv.HandleRWContext("incrby", withArity(opt, 3), planb.ContextHandlerFunc(h.incrby))
+	srv.HandleRWContext("decr", withArity(opt, 2), planb.ContextHandlerFunc(h.decr))
+	srv.HandleRWContext("decrby", withArity(opt, 3), planb.ContextHandlerFunc(h.decrby))
+	srv.HandleRWContext("del", withArity(opt, -2), planb.ContextHandlerFunc(h.del))
+
+	if h.expiring != nil {
+		srv.HandleRO("ttl", withArity(opt, 2), redeo.HandlerFunc(h.ttl))
+		srv.HandleRO("pttl", withArity(opt, 2), redeo.HandlerFunc(h.pttl))
+		srv.HandleRWContext("expire", withArity(opt, 3), planb.ContextHandlerFunc(h.expire))
+		srv.HandleRWContext("pexpire", withArity(opt, 3), planb.ContextHandlerFunc(h.pexpire))
+	}
+}
+
+func withArity(opt *planb.HandlerOpts, arity int) *planb.HandlerOpts {
+	o := new(planb.HandlerOpts)
+	if opt != nil {
+		*o = *opt
+	}
+	o.Arity = arity
+	return o
+}
+
+// --------------------------------------------------------------------
+
+type handlers struct {
+	store    Store
+	expiring ExpiringStore
+}
+
+func (h *handlers) get(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	val, err := h.store.Get(c.Args[0])
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+	appendBulkOrNil(w, val)
+}
+
+func (h *handlers) mget(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() < 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	w.AppendArrayLen(c.ArgN())
+	for _, key := range c.Args {
+		val, err := h.store.Get(key)
+		if err != nil {
+			w.AppendNil()
+			continue
+		}
+		appendBulkOrNil(w, val)
+	}
+}
+
+func (h *handlers) strlen(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	val, err := h.store.Get(c.Args[0])
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+	w.AppendInt(int64(len(val)))
+}
+
+func (h *handlers) exists(w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() < 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	var n int64
+	for _, key := range c.Args {
+		if val, err := h.store.Get(key); val != nil || err == planb.ErrWrongType {
+			n++
+		} else if err != nil {
+			appendError(w, err)
+			return
+		}
+	}
+	w.AppendInt(n)
+}
+
+func (h *handlers) ttl(w resp.ResponseWriter, c *resp.Command) {
+	h.appendTTL(w, c, time.Second)
+}
+
+func (h *handlers) pttl(w resp.ResponseWriter, c *resp.Command) {
+	h.appendTTL(w, c, time.Millisecond)
+}
+
+func (h *handlers) appendTTL(w resp.ResponseWriter, c *resp.Command, unit time.Duration) {
+	if c.ArgN() != 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	ttl, err := h.expiring.TTL(c.Args[0], time.Now())
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+	if ttl < 0 {
+		w.AppendInt(int64(ttl))
+		return
+	}
+	w.AppendInt(int64((ttl + unit/2) / unit))
+}
+
+func (h *handlers) set(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() < 2 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 2; i < c.ArgN(); i++ {
+		switch strings.ToUpper(c.Args[i].String()) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			unit := time.Second
+			if strings.ToUpper(c.Args[i].String()) == "PX" {
+				unit = time.Millisecond
+			}
+			if i++; i == c.ArgN() {
+				appendError(w, errSyntax)
+				return
+			}
+			n, err := c.Args[i].Int()
+			if err != nil {
+				appendError(w, errNotInteger)
+				return
+			} else if n < 1 {
+				appendError(w, errInvalidExpire)
+				return
+			}
+			if ttl, err = expireTTL(n, unit, logTime(ctx)); err != nil {
+				appendError(w, err)
+				return
+			}
+		default:
+			appendError(w, errSyntax)
+			return
+		}
+	}
+	if nx && xx {
+		appendError(w, errSyntax)
+		return
+	}
+
+	if nx || xx {
+		exists, err := h.keyExists(ctx, c.Args[0])
+		if err != nil {
+			appendError(w, err)
+			return
+		}
+		if (nx && exists) || (xx && !exists) {
+			w.AppendNil()
+			return
+		}
+	}
+
+	if err := h.put(ctx, c.Args[0], c.Args[1], ttl); err != nil {
+		appendError(w, err)
+		return
+	}
+	w.AppendOK()
+}
+
+func (h *handlers) setnx(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 2 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	exists, err := h.keyExists(ctx, c.Args[0])
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+	if exists {
+		w.AppendInt(0)
+		return
+	}
+
+	if err := h.store.Put(c.Args[0], c.Args[1]); err != nil {
+		appendError(w, err)
+		return
+	}
+	w.AppendInt(1)
+}
+
+func (h *handlers) getset(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 2 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	val, err := h.getAt(ctx, c.Args[0])
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+	if err := h.store.Put(c.Args[0], c.Args[1]); err != nil {
+		appendError(w, err)
+		return
+	}
+	appendBulkOrNil(w, val)
+}
+
+func (h *handlers) mset(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() < 2 || c.ArgN()%2 != 0 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	for i := 0; i < c.ArgN(); i += 2 {
+		if err := h.store.Put(c.Args[i], c.Args[i+1]); err != nil {
+			appendError(w, err)
+			return
+		}
+	}
+	w.AppendOK()
+}
+
+func (h *handlers) appendValue(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 2 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	val, err := h.getAt(ctx, c.Args[0])
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+
+	val = append(append(make([]byte, 0, len(val)+len(c.Args[1])), val...), c.Args[1]...)
+	if err := h.update(ctx, c.Args[0], val); err != nil {
+		appendError(w, err)
+		return
+	}
+	w.AppendInt(int64(len(val)))
+}
+
+func (h *handlers) incr(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+	h.incrementBy(ctx, w, c.Args[0], 1)
+}
+
+func (h *handlers) decr(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+	h.incrementBy(ctx, w, c.Args[0], -1)
+}
+
+func (h *handlers) incrby(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 2 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	delta, err := c.Args[1].Int()
+	if err != nil {
+		appendError(w, errNotInteger)
+		return
+	}
+	h.incrementBy(ctx, w, c.Args[0], delta)
+}
+
+func (h *handlers) decrby(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() != 2 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	delta, err := c.Args[1].Int()
+	if err != nil || delta == math.MinInt64 {
+		appendError(w, errNotInteger)
+		return
+	}
+	h.incrementBy(ctx, w, c.Args[0], -delta)
+}
+
+func (h *handlers) incrementBy(ctx context.Context, w resp.ResponseWriter, key []byte, delta int64) {
+	val, err := h.getAt(ctx, key)
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+
+	var n int64
+	if val != nil {
+		if n, err = strconv.ParseInt(string(val), 10, 64); err != nil {
+			appendError(w, errNotInteger)
+			return
+		}
+	}
+	if (delta > 0 && n > n+delta) || (delta < 0 && n < n+delta) {
+		appendError(w, errNotInteger)
+		return
+	}
+	n += delta
+
+	if err := h.update(ctx, key, []byte(strconv.FormatInt(n, 10))); err != nil {
+		appendError(w, err)
+		return
+	}
+	w.AppendInt(n)
+}
+
+func (h *handlers) del(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	if c.ArgN() < 1 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	var n int64
+	for _, key := range c.Args {
+		exists, err := h.keyExists(ctx, key)
+		if err != nil {
+			appendError(w, err)
+			return
+		}
+		if !exists {
+			continue
+		}
+		if err := h.store.Delete(key); err != nil {
+			appendError(w, err)
+			return
+		}
+		n++
+	}
+	w.AppendInt(n)
+}
+
+func (h *handlers) expire(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	h.expireIn(ctx, w, c, time.Second)
+}
+
+func (h *handlers) pexpire(ctx context.Context, w resp.ResponseWriter, c *resp.Command) {
+	h.expireIn(ctx, w, c, time.Millisecond)
+}
+
+func (h *handlers) expireIn(ctx context.Context, w resp.ResponseWriter, c *resp.Command, unit time.Duration) {
+	if c.ArgN() != 2 {
+		w.AppendError(redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+
+	n, err := c.Args[1].Int()
+	if err != nil {
+		appendError(w, errNotInteger)
+		return
+	}
+
+	now := logTime(ctx)
+	ttl, err := expireTTL(n, unit, now)
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+
+	ok, err := h.expiring.Expire(c.Args[0], ttl, now)
+	if err != nil {
+		appendError(w, err)
+		return
+	}
+	if !ok {
+		w.AppendInt(0)
+		return
+	}
+	w.AppendInt(1)
+}
+
+// expireTTL converts n units into a ttl, rejecting values
+// which overflow when the expiration is calculated from now.
+func expireTTL(n int64, unit time.Duration, now time.Time) (time.Duration, error) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, errInvalidExpire
+	}
+	ttl := time.Duration(n) * unit
+	if ttl > 0 && int64(ttl) > math.MaxInt64-now.UnixNano() {
+		return 0, errInvalidExpire
+	}
+	return ttl, nil
+}
+
+// --------------------------------------------------------------------
+
+// getAt retrieves a value at the time of the log entry.
+func (h *handlers) getAt(ctx context.Context, key []byte) ([]byte, error) {
+	if h.expiring != nil {
+		return h.expiring.GetAt(key, logTime(ctx))
+	}
+	return h.store.Get(key)
+}
+
+// keyExists returns true if key exists at the time of the log entry.
+func (h *handlers) keyExists(ctx context.Context, key []byte) (bool, error) {
+	val, err := h.getAt(ctx, key)
+	if err == planb.ErrWrongType {
+		return true, nil
+	}
+	return val != nil, err
+}
+
+// put stores a value, with an optional ttl.
+func (h *handlers) put(ctx context.Context, key, val []byte, ttl time.Duration) error {
+	if ttl == 0 {
+		return h.store.Put(key, val)
+	}
+	if h.expiring == nil {
+		return errExpiryNotSupport
+	}
+	return h.expiring.PutWithTTL(key, val, ttl, logTime(ctx))
+}
+
+// update stores a value, retaining an existing ttl.
+func (h *handlers) update(ctx context.Context, key, val []byte) error {
+	if h.expiring == nil {
+		return h.store.Put(key, val)
+	}
+
+	now := logTime(ctx)
+	ttl, err := h.expiring.TTL(key, now)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		return h.expiring.PutWithTTL(key, val, ttl, now)
+	}
+	return h.store.Put(key, val)
+}
+
+// logTime returns the time of the log entry the command
+// is applied from, falls back on the local clock.
+func logTime(ctx context.Context) time.Time {
+	if meta := planb.LogMetaFromContext(ctx); meta != nil && !meta.Time.IsZero() {
+		return meta.Time
+	}
+	return time.Now()
+}
+
+func appendBulkOrNil(w resp.ResponseWriter, val []byte) {
+	if val == nil {
+		w.AppendNil()
+	} else {
+		w.AppendBulk(val)
+	}
+}
+
+func appendError(w resp.ResponseWriter, err error) {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "ERR ") && err != planb.ErrWrongType {
+		msg = "ERR " + msg
+	}
+	w.AppendError(msg)
+}
@@ -0,0 +1,205 @@
+package rediscmd_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bsm/planb"
+	"github.com/bsm/planb/rediscmd"
+	"github.com/bsm/pool"
+	"github.com/bsm/redeo/client"
+	"github.com/bsm/redeo/resp"
+	"github.com/hashicorp/raft"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Register", func() {
+	var dir string
+	var lis net.Listener
+	var srv *planb.Server
+	var store *planb.InmemStore
+	var cln *client.Pool
+
+	var cmd = func(name string, args ...string) interface{} {
+		cn, err := cln.Get()
+		Expect(err).NotTo(HaveOccurred())
+		defer cln.Put(cn)
+
+		cn.WriteCmdString(name, args...)
+		Expect(cn.Flush()).To(Succeed())
+		return readReply(cn)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "planb-rediscmd-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		lis, err = net.Listen("tcp", "127.0.0.1:")
+		Expect(err).NotTo(HaveOccurred())
+		addr := lis.Addr().String()
+
+		conf := planb.NewConfig()
+		conf.Raft.LogOutput = ioutil.Discard
+
+		store = planb.NewInmemStore()
+		rfs := raft.NewInmemStore()
+		srv, err = planb.NewServer(raft.ServerAddress(addr), dir, store, rfs, rfs, conf)
+		Expect(err).NotTo(HaveOccurred())
+		rediscmd.Register(srv, store, nil)
+		go srv.Serve(lis)
+
+		cln, err = client.New(&pool.Options{InitialSize: 1}, func() (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cmd("RAFT", "BOOTSTRAP", addr)).To(Equal("OK"))
+		Eventually(srv.Raft().State, "5s").Should(Equal(raft.Leader))
+	})
+
+	AfterEach(func() {
+		Expect(cln.Close()).To(Succeed())
+		Expect(srv.Close()).To(Succeed())
+		Expect(lis.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should handle strings", func() {
+		Expect(cmd("GET", "key")).To(BeNil())
+		Expect(cmd("SET", "key", "val")).To(Equal("OK"))
+		Expect(cmd("GET", "key")).To(Equal([]byte("val")))
+		Expect(cmd("STRLEN", "key")).To(Equal(int64(3)))
+		Expect(cmd("APPEND", "key", "ue")).To(Equal(int64(5)))
+		Expect(cmd("GETSET", "key", "v2")).To(Equal([]byte("value")))
+
+		Expect(cmd("SET", "key", "v3", "NX")).To(BeNil())
+		Expect(cmd("SET", "other", "v4", "XX")).To(BeNil())
+		Expect(cmd("SETNX", "key", "v5")).To(Equal(int64(0)))
+		Expect(cmd("SETNX", "other", "v5")).To(Equal(int64(1)))
+
+		Expect(cmd("MSET", "k1", "v1", "k2", "v2")).To(Equal("OK"))
+		Expect(cmd("MGET", "k1", "k3", "k2")).To(Equal([]interface{}{[]byte("v1"), nil, []byte("v2")}))
+
+		Expect(cmd("GET")).To(Equal("ERR wrong number of arguments for 'GET' command"))
+		Expect(cmd("MSET", "k1")).To(Equal("ERR wrong number of arguments for 'MSET' command"))
+		Expect(cmd("SET", "key", "val", "BAD")).To(Equal("ERR syntax error"))
+	})
+
+	It("should handle counters", func() {
+		Expect(cmd("INCR", "ctr")).To(Equal(int64(1)))
+		Expect(cmd("INCRBY", "ctr", "10")).To(Equal(int64(11)))
+		Expect(cmd("DECR", "ctr")).To(Equal(int64(10)))
+		Expect(cmd("DECRBY", "ctr", "4")).To(Equal(int64(6)))
+		Expect(cmd("GET", "ctr")).To(Equal([]byte("6")))
+
+		Expect(cmd("SET", "key", "val")).To(Equal("OK"))
+		Expect(cmd("INCR", "key")).To(Equal("ERR value is not an integer or out of range"))
+		Expect(cmd("SET", "max", "9223372036854775807")).To(Equal("OK"))
+		Expect(cmd("INCR", "max")).To(Equal("ERR value is not an integer or out of range"))
+	})
+
+	It("should handle keys", func() {
+		Expect(cmd("MSET", "k1", "v1", "k2", "v2")).To(Equal("OK"))
+		Expect(cmd("EXISTS", "k1", "k2", "k3")).To(Equal(int64(2)))
+		Expect(cmd("DEL", "k1", "k3")).To(Equal(int64(1)))
+		Expect(cmd("EXISTS", "k1", "k2", "k3")).To(Equal(int64(1)))
+	})
+
+	It("should handle expiry", func() {
+		Expect(cmd("SET", "key", "val", "EX", "60")).To(Equal("OK"))
+		Expect(cmd("TTL", "key")).To(Equal(int64(60)))
+		Expect(cmd("INCR", "key")).To(Equal("ERR value is not an integer or out of range"))
+		Expect(cmd("APPEND", "key", "ue")).To(Equal(int64(5)))
+		Expect(cmd("PTTL", "key")).To(BeNumerically("~", 60000, 1000))
+
+		Expect(cmd("SET", "key", "val")).To(Equal("OK"))
+		Expect(cmd("TTL", "key")).To(Equal(int64(-1)))
+		Expect(cmd("TTL", "missing")).To(Equal(int64(-2)))
+
+		Expect(cmd("PEXPIRE", "key", "20")).To(Equal(int64(1)))
+		Expect(cmd("EXPIRE", "missing", "20")).To(Equal(int64(0)))
+		Eventually(func() interface{} { return cmd("GET", "key") }).Should(BeNil())
+		Expect(cmd("SET", "key", "val", "EX", "0")).To(Equal("ERR invalid expire time"))
+		Expect(cmd("SET", "key", "val", "EX", "9223372036854775807")).To(Equal("ERR invalid expire time"))
+		Expect(cmd("EXPIRE", "key", "9223372036854775807")).To(Equal("ERR invalid expire time"))
+	})
+
+	It("should abort transactions on wrong number of arguments", func() {
+		cn, err := cln.Get()
+		Expect(err).NotTo(HaveOccurred())
+		defer cln.Put(cn)
+
+		cn.WriteCmdString("MULTI")
+		cn.WriteCmdString("SET", "key", "val")
+		cn.WriteCmdString("INCR", "key", "extra")
+		cn.WriteCmdString("EXEC")
+		Expect(cn.Flush()).To(Succeed())
+
+		Expect(readReply(cn)).To(Equal("OK"))
+		Expect(readReply(cn)).To(Equal("QUEUED"))
+		Expect(readReply(cn)).To(Equal("ERR wrong number of arguments for 'INCR' command"))
+		Expect(readReply(cn)).To(Equal("EXECABORT Transaction discarded because of previous errors."))
+		Expect(cmd("GET", "key")).To(BeNil())
+	})
+
+	It("should reject typed values", func() {
+		Expect(store.SAdd([]byte("set"), time.Now(), []byte("a"))).To(Equal(1))
+
+		Expect(cmd("GET", "set")).To(Equal("WRONGTYPE Operation against a key holding the wrong kind of value"))
+		Expect(cmd("INCR", "set")).To(Equal("WRONGTYPE Operation against a key holding the wrong kind of value"))
+		Expect(cmd("EXISTS", "set")).To(Equal(int64(1)))
+		Expect(cmd("MGET", "set")).To(Equal([]interface{}{nil}))
+		Expect(cmd("EXPIRE", "set", "60")).To(Equal(int64(1)))
+		Expect(cmd("TTL", "set")).To(Equal(int64(60)))
+		Expect(store.SCard([]byte("set"))).To(Equal(1))
+		Expect(cmd("DEL", "set")).To(Equal(int64(1)))
+	})
+
+})
+
+func readReply(cn resp.ResponseParser) interface{} {
+	t, err := cn.PeekType()
+	Expect(err).NotTo(HaveOccurred())
+
+	switch t {
+	case resp.TypeInline:
+		s, err := cn.ReadInlineString()
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	case resp.TypeError:
+		s, err := cn.ReadError()
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	case resp.TypeInt:
+		n, err := cn.ReadInt()
+		Expect(err).NotTo(HaveOccurred())
+		return n
+	case resp.TypeNil:
+		Expect(cn.ReadNil()).To(Succeed())
+		return nil
+	case resp.TypeArray:
+		n, err := cn.ReadArrayLen()
+		Expect(err).NotTo(HaveOccurred())
+		vv := make([]interface{}, n)
+		for i := range vv {
+			vv[i] = readReply(cn)
+		}
+		return vv
+	}
+
+	b, err := cn.ReadBulk(nil)
+	Expect(err).NotTo(HaveOccurred())
+	return b
+}
+
+// --------------------------------------------------------------------
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "planb/rediscmd")
+}
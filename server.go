@@ -1,26 +1,47 @@
 package planb
 
 import (
+	"bytes"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bsm/redeo"
 	"github.com/bsm/redeo/info"
 	"github.com/bsm/redeo/resp"
 	"github.com/bsm/redeoraft"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
 )
 
 // Server implements a peer
 type Server struct {
-	addr  raft.ServerAddress
-	rsrv  *redeo.Server
-	ctrl  *raft.Raft
-	store Store
+	id       raft.ServerID
+	addr     raft.ServerAddress
+	nonvoter bool
+	priority int
+	dir      string
+	rsrv     *redeo.Server
+	ctrl     *raft.Raft
+	store    Store
+	codec    Codec
+	fwd      *leaderForwarder
+	trans    *transportWrapper
+	batch    *logBatcher
+	pilot    *autopilot
 
+	compression SnapshotCompression
+	progress    *snapshotProgress
+	exports     *snapshotProgress
+	backups     *snapshotProgress
 	handlers    map[string]redeo.Handler
+	readers     map[string]redeo.Handler
+	writeOpts   map[string]*HandlerOpts
+	replayIndex uint64
 	closeOnExit []func() error
 }
 
@@ -44,25 +65,57 @@ func NewServer(advertise raft.ServerAddress, dir string, store Store, logs raft.
 
 	// init server
 	s := &Server{
-		addr:     advertise,
-		rsrv:     redeo.NewServer(nil),
-		store:    store,
-		handlers: make(map[string]redeo.Handler),
+		id:          conf.Raft.LocalID,
+		addr:        advertise,
+		nonvoter:    conf.Cluster.NonVoter,
+		priority:    conf.Cluster.LeaderPriority,
+		dir:         dir,
+		rsrv:        redeo.NewServer(nil),
+		store:       store,
+		codec:       conf.Codec,
+		fwd:         newLeaderForwarder(),
+		compression: conf.Snapshot.Compression,
+		progress:    new(snapshotProgress),
+		exports:     new(snapshotProgress),
+		backups:     new(snapshotProgress),
+		handlers:    make(map[string]redeo.Handler),
+		readers:     make(map[string]redeo.Handler),
+		writeOpts:   make(map[string]*HandlerOpts),
 	}
+	s.closeOnExit = append(s.closeOnExit, s.fwd.Close)
 
-	// init RAFT stable snapshots
-	snaps, err := raft.NewFileSnapshotStoreWithLogger(snapshotRootDir(dir), 2, conf.Raft.Logger)
+	// init RAFT stable snapshots, log to the same output as raft
+	logger := conf.Raft.Logger
+	if logger == nil {
+		out := conf.Raft.LogOutput
+		if out == nil {
+			out = os.Stderr
+		}
+		logger = hclog.New(&hclog.LoggerOptions{
+			Name:   "raft",
+			Level:  hclog.LevelFromString(conf.Raft.LogLevel),
+			Output: out,
+		})
+	}
+	fileSnaps, err := raft.NewFileSnapshotStoreWithLogger(snapshotRootDir(dir), 2, logger.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true}))
 	if err != nil {
 		_ = s.Close()
 		return nil, err
 	}
+	snaps := snapshotStoreWrapper{SnapshotStore: fileSnaps}
 
 	// init RAFT transport
-	trans := redeoraft.NewTransport(s.rsrv, advertise, conf.Transport)
-	s.closeOnExit = append(s.closeOnExit, trans.Close)
+	s.trans = newTransportWrapper(redeoraft.NewTransport(s.rsrv, advertise, conf.Transport))
+	s.closeOnExit = append(s.closeOnExit, s.trans.Close)
+
+	// entries up to the last stored index are replayed on start
+	if s.replayIndex, err = logs.LastIndex(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
 
 	// init RAFT controller
-	ctrl, err := raft.NewRaft(conf.Raft, &fsmWrapper{Server: s}, logs, stable, snaps, trans)
+	ctrl, err := raft.NewRaft(conf.Raft, &fsmWrapper{Server: s}, logs, stable, snaps, s.trans)
 	if err != nil {
 		_ = s.Close()
 		return nil, err
@@ -70,35 +123,123 @@ func NewServer(advertise raft.ServerAddress, dir string, store Store, logs raft.
 	s.ctrl = ctrl
 	s.closeOnExit = append(s.closeOnExit, func() error { return ctrl.Shutdown().Error() })
 
+	// init expiry sweeps
+	if store, ok := store.(ExpiringStore); ok {
+		sweeper := newExpirySweeper(ctrl, store, conf.Expiry.SweepInterval, conf.Expiry.SweepLimit)
+		s.closeOnExit = append(s.closeOnExit, sweeper.Close)
+	}
+
+	// init command batching
+	if conf.Batch.MaxSize > 1 {
+		s.batch = newLogBatcher(ctrl, conf.Batch.MaxSize, conf.Batch.Window)
+		s.closeOnExit = append(s.closeOnExit, s.batch.Close)
+	}
+
+	// init scheduled backups
+	if conf.Backup.Target != nil {
+		scheduler := newBackupScheduler(ctrl, snaps, conf.Backup.Target, conf.Backup.Interval, conf.Backup.Retain, s.backups)
+		s.closeOnExit = append(s.closeOnExit, scheduler.Close)
+	}
+
+	// init automatic cluster formation
+	if len(conf.Cluster.Seeds) != 0 {
+		former := newClusterFormer(ctrl, s.local(), conf.Cluster.Seeds, conf.Cluster.Expect, conf.Cluster.RetryInterval)
+		s.closeOnExit = append(s.closeOnExit, former.Close)
+	}
+
+	// init autopilot
+	s.pilot = newAutopilot(s, conf, logger)
+	s.closeOnExit = append(s.closeOnExit, s.pilot.Close)
+
+	// init leader preference
+	preference := newLeaderPreference(s, conf.Cluster.PriorityCheckInterval)
+	s.closeOnExit = append(s.closeOnExit, preference.Close)
+
 	// expose more info
 	sinf := s.rsrv.Info().Section("Server")
 	sinf.Register("node_id", info.StringValue(conf.Raft.LocalID))
 	sinf.Register("tcp_addr", info.StringValue(advertise))
+	sinf.Register("suffrage", info.Callback(func() string {
+		return strings.ToLower(s.suffrage().String())
+	}))
+	sinf.Register("cluster_size", info.Callback(func() string {
+		size, _ := clusterSize(ctrl)
+		return strconv.Itoa(size)
+	}))
+	sinf.Register("leader_priority", info.IntValue(s.priority))
+	sinf.Register("applied_index", info.Callback(func() string {
+		return strconv.FormatUint(ctrl.AppliedIndex(), 10)
+	}))
+
+	pinf := s.rsrv.Info().Section("Persistence")
+	s.progress.Register(pinf, "snapshot_")
+	s.exports.Register(pinf, "bgsave_")
+	s.backups.Register(pinf, "backup_")
+
+	s.pilot.Register(s.rsrv.Info().Section("Autopilot"))
 
 	// install default commands
-	s.rsrv.Handle("ping", redeo.Ping())
-	s.rsrv.Handle("info", redeo.Info(s.rsrv))
-	s.rsrv.Handle("raft", redeo.SubCommands{
-		"leader":    redeoraft.Leader(ctrl),
-		"stats":     redeoraft.Stats(ctrl),
-		"state":     redeoraft.State(ctrl),
-		"peers":     redeoraft.Peers(ctrl),
-		"add":       redeoraft.AddPeer(ctrl),
-		"remove":    redeoraft.RemovePeer(ctrl),
-		"bootstrap": redeo.HandlerFunc(s.bootstrap),
-	})
+	s.rsrv.Handle("ping", localHandler{s: s, h: redeo.Ping()})
+	s.rsrv.Handle("info", localHandler{s: s, h: redeo.Info(s.rsrv)})
+	s.rsrv.Handle("multi", redeo.HandlerFunc(s.multi))
+	s.rsrv.Handle("exec", redeo.HandlerFunc(s.exec))
+	s.rsrv.Handle("discard", redeo.HandlerFunc(s.discard))
+	s.rsrv.Handle("bgsave", localHandler{s: s, h: redeo.HandlerFunc(s.bgsave)})
+	s.rsrv.Handle("raft", localHandler{s: s, h: redeo.SubCommands{
+		"leader":          redeoraft.Leader(ctrl),
+		"stats":           redeoraft.Stats(ctrl),
+		"state":           redeoraft.State(ctrl),
+		"peers":           redeoraft.Peers(ctrl),
+		"add":             s.leaderRaftCmd(redeoraft.AddPeer(ctrl)),
+		"remove":          s.leaderRaftCmd(redeoraft.RemovePeer(ctrl)),
+		"add-nonvoter":    s.leaderRaftCmd(redeo.HandlerFunc(s.addNonvoter)),
+		"promote":         s.leaderRaftCmd(redeo.HandlerFunc(s.promote)),
+		"demote":          s.leaderRaftCmd(redeo.HandlerFunc(s.demote)),
+		"step-down":       redeo.HandlerFunc(s.stepDown),
+		"transfer-leader": s.leaderRaftCmd(redeo.HandlerFunc(s.transferLeader)),
+		"health":          s.leaderRaftCmd(redeo.HandlerFunc(s.health)),
+		"join":            redeo.HandlerFunc(s.join),
+		"leave":           redeo.HandlerFunc(s.leave),
+		"bootstrap":       redeo.HandlerFunc(s.bootstrap),
+		"snapshot":        redeo.HandlerFunc(s.snapshot),
+		"restore":         redeo.HandlerFunc(s.restore),
+		"forwarder":       redeo.HandlerFunc(forwarder),
+	}})
 
 	// Snables sentinel support if master name given.
 	if name := conf.Sentinel.MasterName; name != "" {
 		broker := redeo.NewPubSubBroker()
-		s.rsrv.Handle("sentinel", redeoraft.Sentinel(name, ctrl, broker))
-		s.rsrv.Handle("publish", broker.Publish())
-		s.rsrv.Handle("subscribe", broker.Subscribe())
+		s.rsrv.Handle("sentinel", localHandler{s: s, h: redeoraft.Sentinel(name, ctrl, broker)})
+		s.rsrv.Handle("publish", localHandler{s: s, h: broker.Publish()})
+		s.rsrv.Handle("subscribe", nonTxHandler{h: broker.Subscribe()})
 	}
 
 	return s, nil
 }
 
+// NewPersistentServer initializes a new server instance, just like NewServer,
+// but creates a durable, file-backed log and stable store in dir.
+func NewPersistentServer(advertise raft.ServerAddress, dir string, store Store, conf *Config) (*Server, error) {
+	// ensure dir is created
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	// init RAFT log and stable store
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewServer(advertise, dir, store, logs, logs, conf)
+	if err != nil {
+		_ = logs.Close()
+		return nil, err
+	}
+	s.closeOnExit = append(s.closeOnExit, logs.Close)
+	return s, nil
+}
+
 // ListenAndServe starts listening and serving
 // on the advertised address.
 func (s *Server) ListenAndServe() error {
@@ -112,20 +253,38 @@ func (s *Server) ListenAndServe() error {
 }
 
 // Serve starts serving in the given listener
-func (s *Server) Serve(lis net.Listener) error { return s.rsrv.Serve(lis) }
+func (s *Server) Serve(lis net.Listener) error { return s.rsrv.Serve(pipelineListener{Listener: lis}) }
 
-// HandleRO handles readonly commands
+// HandleRO handles readonly commands. By default, these are served by any
+// node from the local state, see HandlerOpts.Consistency for stronger
+// guarantees.
 func (s *Server) HandleRO(name string, opt *HandlerOpts, h redeo.Handler) {
-	s.rsrv.Handle(name, h)
+	s.readers[strings.ToLower(name)] = h
+
+	if opt.getConsistency() != ConsistencyStale {
+		h = consistentHandler{s: s, o: opt, h: h}
+	}
+	s.rsrv.Handle(name, queueingHandler{s: s, o: opt, h: h})
 }
 
 // HandleRW handles commands that may result in modifications. These can only be
-// applied to the master node and are then replicated to slaves.
+// applied to the master node and are then replicated to slaves. Followers
+// reject such commands, unless opt.ForwardToLeader is set.
 func (s *Server) HandleRW(name string, opt *HandlerOpts, h redeo.Handler) {
 	s.handlers[strings.ToLower(name)] = h
+	s.writeOpts[strings.ToLower(name)] = opt
 	s.rsrv.Handle(name, replicatingHandler{s: s, o: opt})
 }
 
+// HandleRWContext handles commands that may result in modifications, just like
+// HandleRW. Additionally, the handler receives a context which carries the
+// metadata of the log entry it is applied from, see LogMetaFromContext.
+func (s *Server) HandleRWContext(name string, opt *HandlerOpts, h ContextHandler) {
+	s.HandleRW(name, opt, redeo.HandlerFunc(func(w resp.ResponseWriter, c *resp.Command) {
+		h.ServeRedeoContext(c.Context(), w, c)
+	}))
+}
+
 // Raft exposes the underlying raft node controller
 func (s *Server) Raft() RaftCtrl { return s.ctrl }
 
@@ -169,6 +328,85 @@ func (s *Server) bootstrap(w resp.ResponseWriter, c *resp.Command) {
 	w.AppendOK()
 }
 
+// propose replicates a mutating command and returns the result
+// of its application.
+func (s *Server) propose(c *resp.Command, timeout time.Duration) (interface{}, error) {
+	// raft retains the encoded log entry, the buffer must not be recycled
+	buf := new(bytes.Buffer)
+
+	if s.batch != nil {
+		if err := s.codec.Encode(buf, c); err != nil {
+			return nil, err
+		}
+		return s.batch.Apply(buf.Bytes(), timeout)
+	}
+
+	if err := encodeLogStamp(buf); err != nil {
+		return nil, err
+	}
+	if err := encodeLogEntry(buf, s.codec, c); err != nil {
+		return nil, err
+	}
+	future := s.ctrl.Apply(buf.Bytes(), timeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	return future.Response(), nil
+}
+
+// readAhead consumes the mutating commands which the client that issued c
+// has pipelined behind it, so they can be proposed together with c.
+func (s *Server) readAhead(c *resp.Command) []*resp.Command {
+	if s.batch == nil {
+		return nil
+	}
+
+	cn := getPipelineConn(c)
+	if cn == nil {
+		return nil
+	}
+
+	cmds := cn.ReadAhead(s.batch.maxSize-1, func(cmd *resp.Command) bool {
+		opt, ok := s.writeOpts[strings.ToLower(cmd.Name)]
+		return ok && opt.validArity(cmd)
+	})
+	for _, cmd := range cmds {
+		cmd.SetContext(c.Context())
+	}
+	return cmds
+}
+
+// proposeAll replicates a sequence of mutating commands through the
+// batcher and appends the results in order.
+func (s *Server) proposeAll(w resp.ResponseWriter, cmds []*resp.Command) {
+	var timeout time.Duration
+	var data [][]byte
+	var pos []int
+
+	res := make([]batchResult, len(cmds))
+	for i, c := range cmds {
+		// raft retains the encoded log entry, the buffer must not be recycled
+		buf := new(bytes.Buffer)
+		if err := s.codec.Encode(buf, c); err != nil {
+			res[i].err = err
+			continue
+		}
+		data = append(data, buf.Bytes())
+		pos = append(pos, i)
+
+		if t := s.writeOpts[strings.ToLower(c.Name)].getTimeout(); t > timeout {
+			timeout = t
+		}
+	}
+
+	for i, r := range s.batch.ApplyAll(data, timeout) {
+		res[pos[i]] = r
+	}
+	for i, c := range cmds {
+		appendProposed(s, w, c, s.writeOpts[strings.ToLower(c.Name)], res[i].res, res[i].err)
+	}
+}
+
 func snapshotRootDir(dir string) string {
 	legacy := filepath.Join(dir, "snap")
 	if fi, err := os.Stat(legacy); err == nil && fi.IsDir() {
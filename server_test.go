@@ -53,6 +53,9 @@ var _ = Describe("Server", func() {
 			srv.HandleRO("now", nil, redeo.WrapperFunc(func(cmd *resp.Command) interface{} {
 				return time.Now().Unix()
 			}))
+			srv.HandleRO("bnow", &planb.HandlerOpts{Consistency: planb.ConsistencyBounded}, redeo.WrapperFunc(func(cmd *resp.Command) interface{} {
+				return time.Now().Unix()
+			}))
 			srv.HandleRW("reset", nil, redeo.WrapperFunc(func(cmd *resp.Command) interface{} {
 				return true
 			}))
@@ -83,6 +86,40 @@ var _ = Describe("Server", func() {
 		Expect(string(data)).To(HaveLen(36))
 	}))
 
+	It("should create persistent log stores", func() {
+		dir, err := ioutil.TempDir("", "planb-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		conf := planb.NewConfig()
+		conf.Raft.LogOutput = ioutil.Discard
+
+		srv, err := planb.NewPersistentServer("127.0.0.1:7230", dir, planb.NewInmemStore(), conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srv.Close()).To(Succeed())
+
+		Expect(filepath.Glob(filepath.Join(dir, "*"))).To(ConsistOf(
+			dir+"/node-id",
+			dir+"/raft.db",
+			dir+"/snapshots",
+		))
+
+		// re-open with the same stores
+		srv, err = planb.NewPersistentServer("127.0.0.1:7230", dir, planb.NewInmemStore(), conf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srv.Close()).To(Succeed())
+	})
+
+	It("should report snapshot progress", serve(func(dir string, cn client.Conn) {
+		cn.WriteCmdString("INFO")
+		Expect(cn.Flush()).To(Succeed())
+		Expect(cn.ReadBulkString()).To(SatisfyAll(
+			ContainSubstring("# Persistence\n"),
+			ContainSubstring("snapshot_in_progress:0\n"),
+			ContainSubstring("snapshot_last_status:none\n"),
+		))
+	}))
+
 	It("should handle read-only commands", serve(func(dir string, cn client.Conn) {
 		cn.WriteCmdString("ECHO", "HeLLo")
 		Expect(cn.Flush()).To(Succeed())
@@ -99,4 +136,10 @@ var _ = Describe("Server", func() {
 		Expect(cn.ReadError()).To(Equal("READONLY node is not the leader"))
 	}))
 
+	It("should fail on bounded-staleness reads if out of contact", serve(func(dir string, cn client.Conn) {
+		cn.WriteCmdString("BNOW")
+		Expect(cn.Flush()).To(Succeed())
+		Expect(cn.ReadError()).To(Equal("STALE node is too far behind the leader"))
+	}))
+
 })
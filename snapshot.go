@@ -0,0 +1,347 @@
+package planb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bsm/redeo/info"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	errSnapshotChecksum    = errors.New("planb: snapshot checksum mismatch")
+	errSnapshotCompression = errors.New("planb: unknown snapshot compression")
+)
+
+// SnapshotCompression is a snapshot compression algorithm.
+type SnapshotCompression uint8
+
+const (
+	// CompressionNone disables compression.
+	CompressionNone SnapshotCompression = iota
+	// CompressionGzip compresses snapshots with gzip.
+	CompressionGzip
+	// CompressionSnappy compresses snapshots with snappy, using the framing format.
+	CompressionSnappy
+	// CompressionZstd compresses snapshots with zstd.
+	CompressionZstd
+)
+
+// snapshots are wrapped in an envelope, starting with a magic header, a
+// version and a compression byte, followed by the (compressed) store data and
+// a trailing CRC-32C checksum of all preceding bytes. Snapshots without the
+// magic header were created by older versions and are restored as is.
+var snapshotMagic = []byte("\xffPLB")
+
+const (
+	snapshotEnvelopeV1     byte = 1
+	snapshotHeaderSize          = 6
+	snapshotChecksumSize        = 4
+	snapshotRestorePattern      = "restore-"
+)
+
+var snapshotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotWriter writes enveloped snapshots.
+type snapshotWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	cw  io.WriteCloser
+}
+
+func newSnapshotWriter(w io.Writer, c SnapshotCompression) (*snapshotWriter, error) {
+	crc := crc32.New(snapshotCRCTable)
+	dst := io.MultiWriter(w, crc)
+
+	var cw io.WriteCloser
+	switch c {
+	case CompressionNone:
+		cw = nopWriteCloser{Writer: dst}
+	case CompressionGzip:
+		cw = gzip.NewWriter(dst)
+	case CompressionSnappy:
+		cw = snappy.NewBufferedWriter(dst)
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(dst)
+		if err != nil {
+			return nil, err
+		}
+		cw = enc
+	default:
+		return nil, errSnapshotCompression
+	}
+
+	header := make([]byte, 0, snapshotHeaderSize)
+	header = append(header, snapshotMagic...)
+	header = append(header, snapshotEnvelopeV1, byte(c))
+	if _, err := dst.Write(header); err != nil {
+		_ = cw.Close()
+		return nil, err
+	}
+	return &snapshotWriter{w: w, crc: crc, cw: cw}, nil
+}
+
+// Write implements io.Writer.
+func (s *snapshotWriter) Write(p []byte) (int, error) { return s.cw.Write(p) }
+
+// Close flushes the compressed data and writes the checksum.
+// It does not close the underlying writer.
+func (s *snapshotWriter) Close() error {
+	if err := s.cw.Close(); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, snapshotChecksumSize)
+	binary.BigEndian.PutUint32(trailer, s.crc.Sum32())
+	_, err := s.w.Write(trailer)
+	return err
+}
+
+// Abort releases the compressor without writing the checksum.
+func (s *snapshotWriter) Abort() {
+	_ = s.cw.Close()
+}
+
+// writeSnapshot writes an enveloped snapshot to w.
+func writeSnapshot(w io.Writer, c SnapshotCompression, persist func(io.Writer) error) error {
+	sw, err := newSnapshotWriter(w, c)
+	if err != nil {
+		return err
+	}
+	if err := persist(sw); err != nil {
+		sw.Abort()
+		return err
+	}
+	return sw.Close()
+}
+
+// restoreSnapshot restores store from an enveloped snapshot. The snapshot
+// is spooled to a temporary file in dir and its checksum is verified
+// before the data is passed to the store.
+func restoreSnapshot(dir string, r io.Reader, restore func(io.Reader) error) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(snapshotMagic)); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return restore(br)
+	}
+
+	f, err := ioutil.TempFile(dir, snapshotRestorePattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := spoolSnapshot(f, br)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if header[len(snapshotMagic)] != snapshotEnvelopeV1 {
+		return errInvalidSnapshotFormat
+	}
+
+	body := io.NewSectionReader(f, snapshotHeaderSize, size-snapshotHeaderSize-snapshotChecksumSize)
+	rc, err := newSnapshotDecompressor(bufio.NewReader(body), SnapshotCompression(header[len(snapshotMagic)+1]))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return restore(rc)
+}
+
+// verifySnapshot reads an enveloped snapshot from r and verifies its
+// checksum. It returns the size of the snapshot.
+func verifySnapshot(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(snapshotMagic)); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return 0, errInvalidSnapshotFormat
+	}
+	return spoolSnapshot(ioutil.Discard, br)
+}
+
+// spoolSnapshot copies an enveloped snapshot from r to w and verifies
+// the trailing checksum. It returns the number of bytes copied.
+func spoolSnapshot(w io.Writer, r io.Reader) (int64, error) {
+	spool := &checksumSpool{w: w, crc: crc32.New(snapshotCRCTable)}
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return 0, err
+	}
+	if size < snapshotHeaderSize+snapshotChecksumSize || spool.crc.Sum32() != binary.BigEndian.Uint32(spool.tail) {
+		return 0, errSnapshotChecksum
+	}
+	return size, nil
+}
+
+func newSnapshotDecompressor(r io.Reader, c SnapshotCompression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionNone:
+		return ioutil.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionSnappy:
+		return ioutil.NopCloser(snappy.NewReader(r)), nil
+	case CompressionZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return nil, errSnapshotCompression
+}
+
+// checksumSpool writes all data to w and computes a checksum,
+// except for the trailing checksum bytes, which are retained.
+type checksumSpool struct {
+	w    io.Writer
+	crc  hash.Hash32
+	tail []byte
+}
+
+func (s *checksumSpool) Write(p []byte) (int, error) {
+	s.tail = append(s.tail, p...)
+	if n := len(s.tail) - snapshotChecksumSize; n > 0 {
+		if _, err := s.w.Write(s.tail[:n]); err != nil {
+			return 0, err
+		}
+		_, _ = s.crc.Write(s.tail[:n])
+		s.tail = append(s.tail[:0], s.tail[n:]...)
+	}
+	return len(p), nil
+}
+
+// --------------------------------------------------------------------
+
+// snapshotProgress tracks snapshot writes.
+type snapshotProgress struct {
+	written int64 // atomic, bytes written by the current snapshot
+
+	mu          sync.Mutex
+	started     time.Time // zero unless in progress
+	count       int
+	lastStatus  string
+	lastBytes   int64
+	lastElapsed time.Duration
+}
+
+// Start marks the start of a snapshot write. It returns false
+// if a write is already in progress.
+func (p *snapshotProgress) Start() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.started.IsZero() {
+		return false
+	}
+	p.started = time.Now()
+	atomic.StoreInt64(&p.written, 0)
+	return true
+}
+
+// Done marks the end of a snapshot write.
+func (p *snapshotProgress) Done(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.count++
+	p.lastStatus = "ok"
+	if err != nil {
+		p.lastStatus = "err"
+	}
+	p.lastBytes = atomic.LoadInt64(&p.written)
+	p.lastElapsed = time.Since(p.started)
+	p.started = time.Time{}
+}
+
+// Writer wraps w and counts written bytes.
+func (p *snapshotProgress) Writer(w io.Writer) io.Writer {
+	return &snapshotProgressWriter{Writer: w, p: p}
+}
+
+// Reader wraps r and counts read bytes.
+func (p *snapshotProgress) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, p.Writer(ioutil.Discard))
+}
+
+// snapshotProgressKeys are the keys of snapshotProgress.Stats, in INFO order.
+var snapshotProgressKeys = []string{
+	"in_progress",
+	"current_bytes",
+	"current_time_ms",
+	"count",
+	"last_status",
+	"last_bytes",
+	"last_time_ms",
+}
+
+// Stats returns a map of progress stats.
+func (p *snapshotProgress) Stats() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var inProgress, currentBytes, currentElapsed int64
+	if !p.started.IsZero() {
+		inProgress = 1
+		currentBytes = atomic.LoadInt64(&p.written)
+		currentElapsed = int64(time.Since(p.started) / time.Millisecond)
+	}
+
+	status := p.lastStatus
+	if status == "" {
+		status = "none"
+	}
+
+	return map[string]string{
+		"in_progress":     strconv.FormatInt(inProgress, 10),
+		"current_bytes":   strconv.FormatInt(currentBytes, 10),
+		"current_time_ms": strconv.FormatInt(currentElapsed, 10),
+		"count":           strconv.Itoa(p.count),
+		"last_status":     status,
+		"last_bytes":      strconv.FormatInt(p.lastBytes, 10),
+		"last_time_ms":    strconv.FormatInt(int64(p.lastElapsed/time.Millisecond), 10),
+	}
+}
+
+// Register registers the stats with an INFO section.
+func (p *snapshotProgress) Register(section *info.Section, prefix string) {
+	for _, key := range snapshotProgressKeys {
+		key := key
+		section.Register(prefix+key, info.Callback(func() string { return p.Stats()[key] }))
+	}
+}
+
+type snapshotProgressWriter struct {
+	io.Writer
+	p *snapshotProgress
+}
+
+func (w *snapshotProgressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(&w.p.written, int64(n))
+	return n, err
+}
+
+// --------------------------------------------------------------------
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
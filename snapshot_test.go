@@ -0,0 +1,116 @@
+package planb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("snapshot envelope", func() {
+	var source *InmemStore
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "planb-snapshot-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		source = NewInmemStore()
+		for _, key := range []string{"key1", "key2", "key3"} {
+			Expect(source.Put([]byte(key), bytes.Repeat([]byte("val"), 100))).To(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	var persist = func(c SnapshotCompression) []byte {
+		buf := new(bytes.Buffer)
+		w, err := newSnapshotWriter(buf, c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source.Snapshot(w)).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	for _, c := range []SnapshotCompression{CompressionNone, CompressionGzip, CompressionSnappy, CompressionZstd} {
+		c := c
+		It(fmt.Sprintf("should persist/restore (compression %d)", c), func() {
+			data := persist(c)
+			Expect(data[:4]).To(Equal(snapshotMagic))
+			Expect(data[4:6]).To(Equal([]byte{snapshotEnvelopeV1, byte(c)}))
+			if c != CompressionNone {
+				Expect(len(data)).To(BeNumerically("<", 200))
+			}
+
+			restored := NewInmemStore()
+			Expect(restoreSnapshot(dir, bytes.NewReader(data), restored.Restore)).To(Succeed())
+			Expect(restored.Get([]byte("key2"))).To(Equal(bytes.Repeat([]byte("val"), 100)))
+			Expect(ioutil.ReadDir(dir)).To(BeEmpty())
+		})
+	}
+
+	It("should verify checksums before restoring", func() {
+		data := persist(CompressionGzip)
+		restored := NewInmemStore()
+		Expect(restored.Put([]byte("key4"), []byte("val"))).To(Succeed())
+
+		corrupt := append([]byte(nil), data...)
+		corrupt[len(corrupt)/2]++
+		Expect(restoreSnapshot(dir, bytes.NewReader(corrupt), restored.Restore)).To(MatchError(errSnapshotChecksum))
+		Expect(restoreSnapshot(dir, bytes.NewReader(data[:len(data)-10]), restored.Restore)).To(MatchError(errSnapshotChecksum))
+		Expect(restoreSnapshot(dir, bytes.NewReader(data[:8]), restored.Restore)).To(MatchError(errSnapshotChecksum))
+		Expect(restored.Get([]byte("key4"))).To(Equal([]byte("val")))
+	})
+
+	It("should propagate persist errors", func() {
+		errPersist := errors.New("persist failed")
+		for _, c := range []SnapshotCompression{CompressionNone, CompressionGzip, CompressionSnappy, CompressionZstd} {
+			err := writeSnapshot(new(bytes.Buffer), c, func(io.Writer) error { return errPersist })
+			Expect(err).To(MatchError(errPersist))
+		}
+	})
+
+	It("should reject unknown compressions", func() {
+		_, err := newSnapshotWriter(new(bytes.Buffer), SnapshotCompression(99))
+		Expect(err).To(MatchError(errSnapshotCompression))
+	})
+
+	It("should track progress", func() {
+		progress := new(snapshotProgress)
+		Expect(progress.Stats()).To(HaveKeyWithValue("in_progress", "0"))
+		Expect(progress.Stats()).To(HaveKeyWithValue("last_status", "none"))
+
+		Expect(progress.Start()).To(BeTrue())
+		Expect(progress.Start()).To(BeFalse())
+		buf := new(bytes.Buffer)
+		Expect(writeSnapshot(progress.Writer(buf), CompressionNone, source.Snapshot)).To(Succeed())
+		Expect(progress.Stats()).To(HaveKeyWithValue("in_progress", "1"))
+		Expect(progress.Stats()).To(HaveKeyWithValue("current_bytes", strconv.Itoa(buf.Len())))
+
+		progress.Done(nil)
+		Expect(progress.Stats()).To(HaveKeyWithValue("in_progress", "0"))
+		Expect(progress.Stats()).To(HaveKeyWithValue("count", "1"))
+		Expect(progress.Stats()).To(HaveKeyWithValue("last_status", "ok"))
+		Expect(progress.Stats()).To(HaveKeyWithValue("last_bytes", strconv.Itoa(buf.Len())))
+		Expect(progress.Stats()).To(HaveLen(len(snapshotProgressKeys)))
+	})
+
+	It("should restore snapshots without envelope", func() {
+		buf := new(bytes.Buffer)
+		Expect(source.Snapshot(buf)).To(Succeed())
+
+		restored := NewInmemStore()
+		Expect(restoreSnapshot(dir, buf, restored.Restore)).To(Succeed())
+		Expect(restored.Get([]byte("key1"))).To(Equal(bytes.Repeat([]byte("val"), 100)))
+	})
+
+})
@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bsm/pool"
 	"github.com/bsm/redeo/client"
@@ -17,6 +19,9 @@ import (
 
 var errUnexpectedServerResponse = errors.New("unexpected response")
 
+// sendCommandTimeout limits the duration of sendCommand calls.
+const sendCommandTimeout = 10 * time.Second
+
 // "inspired" by https://github.com/hashicorp/consul
 func normNodeID(conf *raft.Config, fname string) error {
 	nodeID := string(conf.LocalID)
@@ -52,65 +57,116 @@ func normNodeID(conf *raft.Config, fname string) error {
 }
 
 func retrieveServerConfig(addr string) (*raft.Server, error) {
-	pool, err := client.New(&pool.Options{InitialSize: 1}, func() (net.Conn, error) {
-		return net.Dial("tcp", addr)
-	})
+	info, err := retrieveServerInfo(addr)
+	if err != nil {
+		return nil, err
+	}
+	return info.Server()
+}
+
+func retrieveServerInfo(addr string) (serverInfo, error) {
+	raw, err := sendCommand(addr, "INFO")
 	if err != nil {
 		return nil, err
 	}
+	return serverInfo(raw), nil
+}
+
+// sendCommand sends a single command to addr and returns the
+// reply. Error replies are returned as errors.
+func sendCommand(addr string, name string, args ...string) (string, error) {
+	pool, err := dialPool(addr)
+	if err != nil {
+		return "", err
+	}
 	defer pool.Close()
 
+	return sendPoolCommand(pool, sendCommandTimeout, name, args...)
+}
+
+// dialPool creates a connection pool for addr.
+func dialPool(addr string) (*client.Pool, error) {
+	return client.New(&pool.Options{InitialSize: 1}, func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, sendCommandTimeout)
+	})
+}
+
+// sendPoolCommand sends a single command via a connection of pool,
+// see sendCommand.
+func sendPoolCommand(pool *client.Pool, timeout time.Duration, name string, args ...string) (string, error) {
 	cn, err := pool.Get()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer pool.Put(cn)
 
-	cn.WriteCmd("INFO")
+	if err := cn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		cn.MarkFailed()
+		return "", err
+	}
+
+	cn.WriteCmdString(name, args...)
 	if err := cn.Flush(); err != nil {
 		cn.MarkFailed()
-		return nil, err
+		return "", err
 	}
 
 	typ, err := cn.PeekType()
-	if err := cn.Flush(); err != nil {
+	if err != nil {
 		cn.MarkFailed()
-		return nil, err
+		return "", err
 	}
 
+	var reply string
 	switch typ {
 	case resp.TypeBulk:
+		reply, err = cn.ReadBulkString()
+	case resp.TypeInline:
+		reply, err = cn.ReadInlineString()
+	case resp.TypeError:
+		if reply, err = cn.ReadError(); err == nil {
+			err = errors.New(reply)
+		}
+		return "", err
 	default:
-		return nil, errUnexpectedServerResponse
+		cn.MarkFailed()
+		return "", errUnexpectedServerResponse
 	}
-
-	raw, err := cn.ReadBulk(nil)
 	if err != nil {
 		cn.MarkFailed()
-		return nil, err
+		return "", err
 	}
+	return reply, nil
+}
 
-	info := serverInfo(raw)
-	nodeID, err := info.NodeID()
+// --------------------------------------------------------------------
+
+type serverInfo []byte
+
+func (i serverInfo) Server() (*raft.Server, error) {
+	nodeID, err := i.NodeID()
 	if err != nil {
 		return nil, err
 	}
 
-	address, err := info.Address()
+	address, err := i.Address()
 	if err != nil {
 		return nil, err
 	}
 
+	// nodes without suffrage info are voters
+	suffrage := raft.Voter
+	if s, err := i.parse("suffrage"); err == nil && s == "nonvoter" {
+		suffrage = raft.Nonvoter
+	}
+
 	return &raft.Server{
-		ID:      nodeID,
-		Address: address,
+		Suffrage: suffrage,
+		ID:       nodeID,
+		Address:  address,
 	}, nil
 }
 
-// --------------------------------------------------------------------
-
-type serverInfo []byte
-
 func (i serverInfo) NodeID() (raft.ServerID, error) {
 	nodeID, err := i.parse("node_id")
 	if err != nil {
@@ -133,6 +189,30 @@ func (i serverInfo) Address() (raft.ServerAddress, error) {
 	return raft.ServerAddress(address), nil
 }
 
+func (i serverInfo) ClusterSize() (int, error) {
+	size, err := i.parse("cluster_size")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(size)
+}
+
+func (i serverInfo) LeaderPriority() (int, error) {
+	priority, err := i.parse("leader_priority")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(priority)
+}
+
+func (i serverInfo) AppliedIndex() (uint64, error) {
+	index, err := i.parse("applied_index")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(index, 10, 64)
+}
+
 func (i serverInfo) parse(s string) (string, error) {
 	raw := []byte(i)
 	pivot := []byte("\n" + s + ":")
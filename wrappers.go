@@ -2,28 +2,153 @@ package planb
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bsm/redeo"
 	"github.com/bsm/redeo/resp"
 	"github.com/hashicorp/raft"
 )
 
 var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
 
+var (
+	errStaleNode          = errors.New("node is too far behind the leader")
+	errExpiryNotSupported = errors.New("store does not support expiry")
+)
+
 // --------------------------------------------------------------------
 
 type fsmWrapper struct{ *Server }
 
 func (f *fsmWrapper) Apply(log *raft.Log) interface{} {
+	store, ok := f.store.(IndexedStore)
+	if !ok {
+		return f.apply(context.Background(), log)
+	} else if log.Index <= store.AppliedIndex() {
+		return nil
+	}
+
+	var res interface{}
+	if err := store.ApplyIndexed(log.Index, func(ctx context.Context) { res = f.apply(ctx, log) }); err != nil {
+		return err
+	}
+	return res
+}
+
+func (f *fsmWrapper) apply(ctx context.Context, log *raft.Log) interface{} {
+	meta := &LogMeta{
+		Index:  log.Index,
+		Term:   log.Term,
+		Replay: log.Index <= f.replayIndex,
+		parent: ctx,
+	}
+
+	data := log.Data
+	if len(data) != 0 && data[0] == logEntryStamped {
+		stamp, rest, err := decodeLogStamp(data[1:])
+		if err != nil {
+			return err
+		}
+		meta.Time, meta.Seed, data = stamp.Time, stamp.Seed, rest
+	}
+
+	if len(data) != 0 {
+		switch data[0] {
+		case logEntryBatch:
+			return f.applyBatch(meta, data[1:])
+		case logEntryMulti:
+			return f.applyMulti(meta, data[1:])
+		case logEntryExpire:
+			return f.applyExpire(meta, data[1:])
+		}
+	}
+
 	var cmd resp.Command
-	if err := gob.NewDecoder(bytes.NewReader(log.Data)).Decode(&cmd); err != nil {
+	if err := decodeLogEntry(data, f.codec, &cmd); err != nil {
+		return err
+	}
+	cmd.SetContext(meta.context(0))
+	return f.exec(&cmd)
+}
+
+func (f *fsmWrapper) applyBatch(meta *LogMeta, data []byte) interface{} {
+	entries, err := decodeCommandsEntry(data)
+	if err != nil {
+		return err
+	}
+
+	res := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		var cmd resp.Command
+		if err := f.codec.Decode(entry, &cmd); err != nil {
+			res[i] = err
+			continue
+		}
+		cmd.SetContext(meta.context(i))
+		res[i] = f.exec(&cmd)
+	}
+	return res
+}
+
+func (f *fsmWrapper) applyMulti(meta *LogMeta, data []byte) interface{} {
+	entries, err := decodeCommandsEntry(data)
+	if err != nil {
+		return err
+	}
+
+	b := bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+
+	w := resp.NewResponseWriter(b)
+	w.AppendArrayLen(len(entries))
+	for i, entry := range entries {
+		var cmd resp.Command
+		if err := f.codec.Decode(entry, &cmd); err != nil {
+			w.AppendError("ERR " + err.Error())
+			continue
+		}
+		cmd.SetContext(meta.context(i))
+
+		if h, ok := f.handlers[strings.ToLower(cmd.Name)]; ok {
+			h.ServeRedeo(w, &cmd)
+		} else if h, ok := f.readers[strings.ToLower(cmd.Name)]; ok {
+			h.ServeRedeo(w, &cmd)
+		} else {
+			w.AppendError(redeo.UnknownCommand(cmd.Name))
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		bufPool.Put(b)
 		return err
 	}
+	return b
+}
 
+func (f *fsmWrapper) applyExpire(meta *LogMeta, data []byte) interface{} {
+	keys, err := decodeCommandsEntry(data)
+	if err != nil {
+		return err
+	}
+
+	store, ok := f.store.(ExpiringStore)
+	if !ok {
+		return errExpiryNotSupported
+	}
+	if err := store.DeleteExpired(keys, meta.Time); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *fsmWrapper) exec(cmd *resp.Command) interface{} {
 	h, ok := f.handlers[strings.ToLower(cmd.Name)]
 	if !ok {
 		return fmt.Errorf("unknown command '%s'", cmd.Name)
@@ -33,7 +158,7 @@ func (f *fsmWrapper) Apply(log *raft.Log) interface{} {
 	b.Reset()
 
 	w := resp.NewResponseWriter(b)
-	h.ServeRedeo(w, &cmd)
+	h.ServeRedeo(w, cmd)
 
 	if err := w.Flush(); err != nil {
 		bufPool.Put(b)
@@ -42,14 +167,59 @@ func (f *fsmWrapper) Apply(log *raft.Log) interface{} {
 	return b
 }
 
-func (f *fsmWrapper) Restore(rc io.ReadCloser) error      { return f.store.Restore(rc) }
-func (f *fsmWrapper) Snapshot() (raft.FSMSnapshot, error) { return &fsmSnapshot{Store: f.store}, nil }
+func (f *fsmWrapper) Restore(rc io.ReadCloser) error {
+	store, ok := f.store.(IndexedStore)
+	src, known := rc.(*snapshotSource)
+	if !ok || !known {
+		return restoreSnapshot(f.dir, rc, f.store.Restore)
+	}
+
+	// raft restores the latest snapshot on every start,
+	// skip snapshots which have already been applied
+	if src.meta.Index <= store.AppliedIndex() {
+		return nil
+	}
+	return restoreSnapshot(f.dir, rc, func(r io.Reader) error {
+		return store.RestoreIndexed(r, src.meta.Index)
+	})
+}
+
+func (f *fsmWrapper) Snapshot() (raft.FSMSnapshot, error) {
+	if store, ok := f.store.(Snapshotter); ok {
+		snap, err := store.Freeze()
+		if err != nil {
+			return nil, err
+		}
+		return &fsmFrozenSnapshot{s: f.Server, snap: snap}, nil
+	}
+	return &fsmSnapshot{s: f.Server}, nil
+}
 
-type fsmSnapshot struct{ Store }
+type fsmSnapshot struct{ s *Server }
 
 func (s *fsmSnapshot) Release() {}
 func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
-	if err := s.Snapshot(sink); err != nil {
+	return s.s.persistSnapshot(sink, s.s.store.Snapshot)
+}
+
+// fsmFrozenSnapshot is persisted from an immutable view,
+// without blocking the application of commands.
+type fsmFrozenSnapshot struct {
+	s    *Server
+	snap StoreSnapshot
+}
+
+func (s *fsmFrozenSnapshot) Release() { s.snap.Release() }
+func (s *fsmFrozenSnapshot) Persist(sink raft.SnapshotSink) error {
+	return s.s.persistSnapshot(sink, s.snap.Persist)
+}
+
+func (s *Server) persistSnapshot(sink raft.SnapshotSink, persist func(io.Writer) error) error {
+	s.progress.Start()
+	err := writeSnapshot(s.progress.Writer(sink), s.compression, persist)
+	s.progress.Done(err)
+
+	if err != nil {
 		_ = sink.Cancel()
 		return err
 	}
@@ -58,26 +228,146 @@ func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 
 // --------------------------------------------------------------------
 
+// snapshotStoreWrapper attaches the metadata to opened snapshots, the FSM
+// needs to know the index of the snapshot it restores.
+type snapshotStoreWrapper struct{ raft.SnapshotStore }
+
+// Open implements raft.SnapshotStore.
+func (s snapshotStoreWrapper) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := s.SnapshotStore.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, &snapshotSource{ReadCloser: rc, meta: meta}, nil
+}
+
+type snapshotSource struct {
+	io.ReadCloser
+	meta *raft.SnapshotMeta
+}
+
+// --------------------------------------------------------------------
+
+// transportWrapper tracks the commit index of the leader, as
+// received with AppendEntries requests.
+type transportWrapper struct {
+	raft.Transport
+
+	commitIndex uint64 // atomic
+	consumer    chan raft.RPC
+
+	closing chan struct{}
+	closer  sync.Once
+}
+
+func newTransportWrapper(trans raft.Transport) *transportWrapper {
+	t := &transportWrapper{
+		Transport: trans,
+		consumer:  make(chan raft.RPC),
+		closing:   make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// LeaderCommitIndex returns the last known commit index of the leader.
+func (t *transportWrapper) LeaderCommitIndex() uint64 {
+	return atomic.LoadUint64(&t.commitIndex)
+}
+
+// Consumer implements raft.Transport.
+func (t *transportWrapper) Consumer() <-chan raft.RPC { return t.consumer }
+
+// Close implements raft.WithClose.
+func (t *transportWrapper) Close() error {
+	t.closer.Do(func() { close(t.closing) })
+
+	if closeable, ok := t.Transport.(raft.WithClose); ok {
+		return closeable.Close()
+	}
+	return nil
+}
+
+func (t *transportWrapper) loop() {
+	for {
+		select {
+		case <-t.closing:
+			return
+		case rpc := <-t.Transport.Consumer():
+			if req, ok := rpc.Command.(*raft.AppendEntriesRequest); ok {
+				t.observe(req.LeaderCommitIndex)
+			}
+
+			select {
+			case t.consumer <- rpc:
+			case <-t.closing:
+				rpc.Respond(nil, raft.ErrTransportShutdown)
+				return
+			}
+		}
+	}
+}
+
+func (t *transportWrapper) observe(index uint64) {
+	for {
+		current := atomic.LoadUint64(&t.commitIndex)
+		if index <= current || atomic.CompareAndSwapUint64(&t.commitIndex, current, index) {
+			return
+		}
+	}
+}
+
+// --------------------------------------------------------------------
+
 type replicatingHandler struct {
 	s *Server
 	o *HandlerOpts
 }
 
 func (h replicatingHandler) ServeRedeo(w resp.ResponseWriter, c *resp.Command) {
-	buf := bufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bufPool.Put(buf)
+	tx := getTx(c)
+	if !h.o.validArity(c) {
+		tx.Fail(w, redeo.WrongNumberOfArgs(c.Name))
+		return
+	}
+	if tx.Active() {
+		tx.Queue(w, h.s.codec, h.o, c)
+		return
+	}
 
-	if err := gob.NewEncoder(buf).Encode(c); err != nil {
-		w.AppendError("ERR " + err.Error())
+	if cmds := h.s.readAhead(c); len(cmds) != 0 {
+		h.s.proposeAll(w, append([]*resp.Command{c}, cmds...))
 		return
 	}
 
-	future := h.s.ctrl.Apply(buf.Bytes(), h.o.getTimeout())
-	err := future.Error()
+	res, err := h.s.propose(c, h.o.getTimeout())
+	appendProposed(h.s, w, c, h.o, res, err)
+}
+
+// --------------------------------------------------------------------
+
+type consistentHandler struct {
+	s *Server
+	o *HandlerOpts
+	h redeo.Handler
+}
+
+func (h consistentHandler) ServeRedeo(w resp.ResponseWriter, c *resp.Command) {
+	err := h.verify()
 	switch err {
-	case raft.ErrNotLeader:
-		w.AppendError("READONLY " + err.Error())
+	case raft.ErrNotLeader, raft.ErrLeadershipLost:
+		if h.o.forwardToLeader() {
+			forwardToLeader(h.s, w, c, h.o, "NOTLEADER")
+			return
+		}
+		w.AppendError("NOTLEADER " + raft.ErrNotLeader.Error())
+		return
+	case errStaleNode:
+		if h.o.forwardToLeader() {
+			forwardToLeader(h.s, w, c, h.o, "STALE")
+			return
+		}
+		w.AppendError("STALE " + err.Error())
 		return
 	default:
 		w.AppendError("ERR " + err.Error())
@@ -85,15 +375,108 @@ func (h replicatingHandler) ServeRedeo(w resp.ResponseWriter, c *resp.Command) {
 	case nil:
 	}
 
-	switch res := future.Response().(type) {
+	h.h.ServeRedeo(w, c)
+}
+
+func (h consistentHandler) verify() error {
+	switch h.o.getConsistency() {
+	case ConsistencyLinearizable:
+		return h.verifyLinearizable()
+	case ConsistencyBounded:
+		return h.verifyBounded()
+	}
+
+	if h.s.ctrl.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	return nil
+}
+
+func (h consistentHandler) verifyLinearizable() error {
+	ctrl := h.s.ctrl
+	if ctrl.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+
+	// remember the read index, confirm leadership
+	index := ctrl.LastIndex()
+	if err := ctrl.VerifyLeader().Error(); err != nil {
+		return err
+	}
+
+	// wait for the FSM to catch up, if required
+	if ctrl.AppliedIndex() < index {
+		return ctrl.Barrier(h.o.getTimeout()).Error()
+	}
+	return nil
+}
+
+func (h consistentHandler) verifyBounded() error {
+	ctrl := h.s.ctrl
+	switch ctrl.State() {
+	case raft.Leader:
+		return nil
+	case raft.Follower:
+	default:
+		return errStaleNode
+	}
+
+	if time.Since(ctrl.LastContact()) > h.o.getMaxStaleness() {
+		return errStaleNode
+	}
+
+	if max := h.o.getMaxLagEntries(); max != 0 {
+		commitIndex := h.s.trans.LeaderCommitIndex()
+		if applied := ctrl.AppliedIndex(); applied < commitIndex && commitIndex-applied > max {
+			return errStaleNode
+		}
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+func appendResult(w resp.ResponseWriter, res interface{}) {
+	switch res := res.(type) {
 	case *bytes.Buffer:
-		if _, err := res.WriteTo(w); err != nil {
+		// w.Write bypasses the output buffer, flush pending
+		// responses first to retain the order of pipelined replies
+		if err := w.Flush(); err != nil {
+			w.AppendError("ERR " + err.Error())
+		} else if _, err := res.WriteTo(w); err != nil {
 			w.AppendError("ERR " + err.Error())
 		}
 		bufPool.Put(res)
 	case error:
-		w.AppendError("ERR " + err.Error())
+		w.AppendError("ERR " + res.Error())
 	default:
 		w.AppendNil()
 	}
 }
+
+// appendProposed appends the outcome of a proposed command.
+func appendProposed(s *Server, w resp.ResponseWriter, c *resp.Command, o *HandlerOpts, res interface{}, err error) {
+	switch err {
+	case raft.ErrNotLeader:
+		if o.forwardToLeader() {
+			forwardToLeader(s, w, c, o, "READONLY")
+			return
+		}
+		w.AppendError("READONLY " + err.Error())
+		return
+	default:
+		w.AppendError("ERR " + err.Error())
+		return
+	case nil:
+	}
+
+	appendResult(w, res)
+}
+
+func forwardToLeader(s *Server, w resp.ResponseWriter, c *resp.Command, o *HandlerOpts, errPrefix string) {
+	if err := s.fwd.Forward(s.ctrl.Leader(), w, c, o.getTimeout()); err == errNoLeader {
+		w.AppendError(errPrefix + " " + raft.ErrNotLeader.Error())
+	} else if err != nil {
+		w.AppendErrorf("ERR unable to forward to leader: %s", err.Error())
+	}
+}
@@ -0,0 +1,143 @@
+package planb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/bsm/redeo"
+	"github.com/bsm/redeo/resp"
+	"github.com/hashicorp/raft"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transportWrapper", func() {
+	var subject *transportWrapper
+	var leader *raft.InmemTransport
+
+	BeforeEach(func() {
+		var follower *raft.InmemTransport
+		_, leader = raft.NewInmemTransport("leader")
+		_, follower = raft.NewInmemTransport("follower")
+		leader.Connect("follower", follower)
+
+		subject = newTransportWrapper(follower)
+		go func() {
+			for rpc := range subject.Consumer() {
+				rpc.Respond(&raft.AppendEntriesResponse{Success: true}, nil)
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		Expect(subject.Close()).To(Succeed())
+	})
+
+	var appendEntries = func(commitIndex uint64) error {
+		return leader.AppendEntries("follower", "follower", &raft.AppendEntriesRequest{
+			Term:              1,
+			LeaderCommitIndex: commitIndex,
+		}, new(raft.AppendEntriesResponse))
+	}
+
+	It("should track the leader commit index", func() {
+		Expect(subject.LeaderCommitIndex()).To(Equal(uint64(0)))
+
+		Expect(appendEntries(8)).To(Succeed())
+		Expect(subject.LeaderCommitIndex()).To(Equal(uint64(8)))
+
+		Expect(appendEntries(4)).To(Succeed())
+		Expect(subject.LeaderCommitIndex()).To(Equal(uint64(8)))
+
+		Expect(appendEntries(12)).To(Succeed())
+		Expect(subject.LeaderCommitIndex()).To(Equal(uint64(12)))
+	})
+})
+
+var _ = Describe("fsmWrapper", func() {
+	var subject *fsmWrapper
+	var store *indexedInmemStore
+	var snapshot []byte
+
+	BeforeEach(func() {
+		source := NewInmemStore()
+		Expect(source.Put([]byte("key"), []byte("v2"))).To(Succeed())
+
+		buf := new(bytes.Buffer)
+		Expect(source.Snapshot(buf)).To(Succeed())
+		snapshot = buf.Bytes()
+
+		store = &indexedInmemStore{InmemStore: NewInmemStore()}
+		Expect(store.Put([]byte("key"), []byte("v1"))).To(Succeed())
+		subject = &fsmWrapper{Server: &Server{store: store}}
+	})
+
+	var restore = func(index uint64) error {
+		return subject.Restore(&snapshotSource{
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(snapshot)),
+			meta:       &raft.SnapshotMeta{Index: index},
+		})
+	}
+
+	It("should skip snapshots which have already been applied", func() {
+		store.applied = 8
+		Expect(restore(5)).To(Succeed())
+		Expect(store.Get([]byte("key"))).To(Equal([]byte("v1")))
+		Expect(store.applied).To(Equal(uint64(8)))
+	})
+
+	It("should reset the applied index on restore", func() {
+		store.applied = 3
+		Expect(restore(5)).To(Succeed())
+		Expect(store.Get([]byte("key"))).To(Equal([]byte("v2")))
+		Expect(store.applied).To(Equal(uint64(5)))
+	})
+
+	It("should pass store contexts to handlers", func() {
+		var seen interface{}
+		subject.codec = BinaryCodec{}
+		subject.handlers = map[string]redeo.Handler{
+			"set": redeo.HandlerFunc(func(w resp.ResponseWriter, c *resp.Command) {
+				seen = c.Context().Value(ctxKeyTestStore{})
+				w.AppendOK()
+			}),
+		}
+
+		buf := new(bytes.Buffer)
+		Expect(encodeLogEntry(buf, subject.codec, resp.NewCommand("SET", resp.CommandArgument("key")))).To(Succeed())
+		Expect(subject.Apply(&raft.Log{Index: 4, Data: buf.Bytes()})).To(BeAssignableToTypeOf(buf))
+		Expect(seen).To(Equal(uint64(4)))
+		Expect(store.applied).To(Equal(uint64(4)))
+	})
+
+	It("should skip log entries which have already been applied", func() {
+		store.applied = 3
+		Expect(subject.Apply(&raft.Log{Index: 3})).To(BeNil())
+		Expect(store.applied).To(Equal(uint64(3)))
+	})
+})
+
+type indexedInmemStore struct {
+	*InmemStore
+	applied uint64
+}
+
+func (s *indexedInmemStore) AppliedIndex() uint64 { return s.applied }
+
+type ctxKeyTestStore struct{}
+
+func (s *indexedInmemStore) ApplyIndexed(index uint64, apply func(context.Context)) error {
+	apply(context.WithValue(context.Background(), ctxKeyTestStore{}, index))
+	s.applied = index
+	return nil
+}
+
+func (s *indexedInmemStore) RestoreIndexed(r io.Reader, index uint64) error {
+	if err := s.Restore(r); err != nil {
+		return err
+	}
+	s.applied = index
+	return nil
+}